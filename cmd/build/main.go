@@ -2,36 +2,97 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
-	"github.com/buildpack/libbuildpack/buildplan"
 	"github.com/cloudfoundry/libcfbuildpack/build"
+	"github.com/cloudfoundry/npm-cnb/git"
+	"github.com/cloudfoundry/npm-cnb/metrics"
 	"github.com/cloudfoundry/npm-cnb/modules"
 	"github.com/cloudfoundry/npm-cnb/npm"
 	"github.com/cloudfoundry/npm-cnb/utils"
 )
 
 func main() {
+	utils.SandboxMain()
+
+	// Output is redacted from before the logger is created, as it keeps the stdout and stderr it was created with
+	redactor := utils.NewRedactor()
+	if err := redactor.AddEnvironment(os.Environ()); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to read credentials to redact: %s", err)
+		os.Exit(100)
+	}
+
+	restore, err := utils.RedactOutput(redactor)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to redact output: %s", err)
+		os.Exit(100)
+	}
+
 	context, err := build.DefaultBuild()
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "failed to create default build context: %s", err)
+		restore()
 		os.Exit(100)
 	}
 
-	code, err := runBuild(context)
+	code, err := runBuild(context, redactor)
 	if err != nil {
 		context.Logger.Info(err.Error())
 	}
 
+	restore()
 	os.Exit(code)
 }
 
-func runBuild(context build.Build) (int, error) {
-	context.Logger.FirstLine(context.Logger.PrettyIdentity(context.Buildpack))
+func runBuild(context build.Build, redactor *utils.Redactor) (int, error) {
+	context.Logger.Title(context.Buildpack)
 
-	packageManager := npm.NPM{
-		Runner: utils.CommandRunner{},
-		Logger: context.Logger,
+	if err := redactor.AddBindings(filepath.Join(context.Platform.Root, "bindings")); err != nil {
+		return context.Failure(102), fmt.Errorf("unable to read credentials to redact: %s", err.Error())
+	}
+
+	recorder := metrics.NewRecorder()
+
+	env, err := commandEnv(context)
+	if err != nil {
+		return context.Failure(102), err
+	}
+
+	nodeGyp, err := nodeGypEnv(context)
+	if err != nil {
+		return context.Failure(102), err
+	}
+	env = append(env, nodeGyp...)
+
+	scriptRunner, err := newScriptRunner(context, env)
+	if err != nil {
+		return context.Failure(102), err
+	}
+
+	sshDir, err := ioutil.TempDir("", "git-ssh")
+	if err != nil {
+		return context.Failure(102), err
+	}
+	defer os.RemoveAll(sshDir)
+
+	sshCommand, err := git.ConfigureSSH(bindingRoots(context), sshDir, context.Logger)
+	if err != nil {
+		return context.Failure(102), fmt.Errorf("unable to configure SSH for git dependencies: %s", err.Error())
+	}
+
+	// git, cloning for npm, only reads the cached clones, so only the git client needs SSH and may not prompt
+	gitEnv := append([]string{"GIT_TERMINAL_PROMPT=0"}, env...)
+	if sshCommand != "" {
+		gitEnv = append(gitEnv, "GIT_SSH_COMMAND="+sshCommand)
+	}
+
+	packageManager := &npm.NPM{
+		Runner:       utils.CommandRunner{Env: env, Logger: context.Logger},
+		ScriptRunner: scriptRunner,
+		Logger:       context.Logger,
+		Metrics:      recorder,
 	}
 
 	contributor, willContribute, err := modules.NewContributor(context, packageManager)
@@ -40,10 +101,98 @@ func runBuild(context build.Build) (int, error) {
 	}
 
 	if willContribute {
+		contributor.Metrics = recorder
+		contributor.Git = git.Git{Runner: utils.CommandRunner{Env: gitEnv, Logger: context.Logger}, Logger: context.Logger}
+		contributor.GitSSH = sshCommand != ""
+
+		// npm only reads the git config pointing at the cached clones when there are git dependencies to install
+		if contributor.HasGitDependencies() {
+			gitCache := context.Layers.Layer(modules.GitCache)
+			packageManager.Runner = utils.CommandRunner{Env: append(env, modules.GitEnv(gitCache)...), Logger: context.Logger}
+		}
+
 		if err := contributor.Contribute(); err != nil {
 			return context.Failure(103), err
 		}
+
+		if err := recorder.Report(context.Layers.Layer(metrics.Dependency), context.Logger); err != nil {
+			return context.Failure(104), err
+		}
+	}
+
+	return context.Success()
+}
+
+// bindingRoots are the directories service bindings may be mounted in
+func bindingRoots(context build.Build) []string {
+	return []string{filepath.Join(context.Platform.Root, "bindings"), os.Getenv("SERVICE_BINDING_ROOT"), os.Getenv("CNB_BINDINGS")}
+}
+
+// commandEnv returns the variables passed to npm besides the allowlisted ones: those set by earlier buildpacks, other
+// than credentials, and those the app's .npmrc refers to
+func commandEnv(context build.Build) ([]string, error) {
+	names, err := utils.BuildpackEnv(filepath.Dir(context.Layers.Root))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read buildpack environment: %s", err.Error())
+	}
+
+	var env []string
+	for _, name := range names {
+		if !utils.Credential(name) {
+			env = append(env, name)
+		}
+	}
+
+	references, err := npm.NPMRCVariables(context.Application.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(env, references...), nil
+}
+
+// nodeGypEnv sets node-gyp's devdir, where it keeps downloaded Node.js headers, to the native cache layer, and its
+// nodedir to the installed node when that has headers
+func nodeGypEnv(context build.Build) ([]string, error) {
+	env := []string{"npm_config_devdir=" + filepath.Join(context.Layers.Layer(modules.NativeCache).Root, modules.NodeGypDir)}
+
+	nodeDir, err := npm.InstalledHeaders()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find Node.js headers: %s", err.Error())
+	}
+
+	if nodeDir != "" {
+		env = append(env, "npm_config_nodedir="+nodeDir)
+	}
+
+	return env, nil
+}
+
+// newScriptRunner returns the runner for dependency install scripts, which may only write to node_modules, the npm
+// cache and node-gyp's headers, and may not read the platform's bindings and environment or the app's .npmrc
+func newScriptRunner(context build.Build, env []string) (npm.Runner, error) {
+	enabled, network, err := utils.ParseSandboxEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled {
+		context.Logger.Info("Running install scripts without a sandbox")
+		return utils.CommandRunner{Env: env, Logger: context.Logger}, nil
 	}
 
-	return context.Success(buildplan.BuildPlan{})
+	return utils.Sandbox{
+		Writable: []string{
+			modules.ModulesDir,
+			modules.CacheDir,
+			filepath.Join(context.Layers.Layer(modules.NativeCache).Root, modules.NodeGypDir),
+		},
+		Hidden: []string{
+			context.Platform.Root,
+			filepath.Join(context.Application.Root, npm.NPMRC),
+		},
+		Env:     env,
+		Network: network,
+		Logger:  context.Logger,
+	}, nil
 }
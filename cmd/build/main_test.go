@@ -7,6 +7,7 @@ import (
 
 	"github.com/cloudfoundry/libcfbuildpack/build"
 	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/utils"
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
 )
@@ -22,7 +23,7 @@ func testBuild(t *testing.T, _ spec.G, it spec.S) {
 
 	it("always passes", func() {
 		f := test.NewBuildFactory(t)
-		code, err := runBuild(f.Build)
+		code, err := runBuild(f.Build, utils.NewRedactor())
 		Expect(err).ToNot(HaveOccurred())
 		Expect(code).To(Equal(build.SuccessStatusCode))
 	})
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -9,7 +11,6 @@ import (
 
 	"github.com/buildpack/libbuildpack/buildplan"
 	"github.com/cloudfoundry/libcfbuildpack/detect"
-	"github.com/cloudfoundry/nodejs-cnb/node"
 	"github.com/cloudfoundry/npm-cnb/modules"
 )
 
@@ -37,18 +38,80 @@ func runDetect(context detect.Detect) (int, error) {
 		return context.Fail(), fmt.Errorf(`no "package.json" found at: %s`, packageJSON)
 	}
 
-	version, err := node.GetVersion(packageJSON)
+	version, err := nodeVersion(packageJSON)
+	modulesMetadata := buildplan.Metadata{"launch": true}
 	if err != nil {
-		return context.Fail(), fmt.Errorf(`unable to parse "package.json": %s`, err.Error())
+		// A broken package.json still means this is a Node app, so pass and let the build fail loudly
+		context.Logger.Info(`unable to parse "package.json": %s`, err.Error())
+		modulesMetadata[modules.PackageJSONError] = err.Error()
 	}
 
-	return context.Pass(buildplan.BuildPlan{
-		node.Dependency: buildplan.Dependency{
-			Version:  version,
-			Metadata: buildplan.Metadata{"build": true, "launch": true},
-		},
-		modules.Dependency: buildplan.Dependency{
-			Metadata: buildplan.Metadata{"launch": true},
+	return context.Pass(buildplan.Plan{
+		Provides: []buildplan.Provided{{Name: modules.Dependency}},
+		Requires: []buildplan.Required{
+			{
+				Name:     modules.Node,
+				Version:  version,
+				Metadata: buildplan.Metadata{"build": true, "launch": true},
+			},
+			{
+				Name:     modules.Dependency,
+				Metadata: modulesMetadata,
+			},
 		},
 	})
 }
+
+func nodeVersion(packageJSON string) (string, error) {
+	buf, err := ioutil.ReadFile(packageJSON)
+	if err != nil {
+		return "", err
+	}
+
+	pkg := struct {
+		Engines struct {
+			Node string `json:"node"`
+		} `json:"engines"`
+	}{}
+
+	if err := json.Unmarshal(buf, &pkg); err != nil {
+		var offset int64
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			offset = e.Offset
+		case *json.UnmarshalTypeError:
+			offset = e.Offset
+		default:
+			return "", err
+		}
+
+		line, column := position(buf, offset)
+		return "", fmt.Errorf("line %d, column %d: %s", line, column, err.Error())
+	}
+
+	return pkg.Engines.Node, nil
+}
+
+// position converts the offset reported by encoding/json, which points just past the offending byte, into a
+// 1-based line and column
+func position(buf []byte, offset int64) (int, int) {
+	if offset > int64(len(buf)) {
+		offset = int64(len(buf))
+	}
+
+	if offset < 1 {
+		offset = 1
+	}
+
+	line, column := 1, 1
+	for _, b := range buf[:offset-1] {
+		if b == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+
+	return line, column
+}
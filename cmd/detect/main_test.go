@@ -8,7 +8,6 @@ import (
 	"github.com/buildpack/libbuildpack/buildplan"
 	"github.com/cloudfoundry/libcfbuildpack/detect"
 	"github.com/cloudfoundry/libcfbuildpack/test"
-	"github.com/cloudfoundry/nodejs-cnb/node"
 	"github.com/cloudfoundry/npm-cnb/modules"
 	. "github.com/onsi/gomega"
 	"github.com/sclevine/spec"
@@ -41,13 +40,18 @@ func testDetect(t *testing.T, when spec.G, it spec.S) {
 
 			Expect(code).To(Equal(detect.PassStatusCode))
 
-			Expect(factory.Output).To(Equal(buildplan.BuildPlan{
-				node.Dependency: buildplan.Dependency{
-					Version:  version,
-					Metadata: buildplan.Metadata{"build": true, "launch": true},
-				},
-				modules.Dependency: buildplan.Dependency{
-					Metadata: buildplan.Metadata{"launch": true},
+			Expect(factory.Plans.Plan).To(Equal(buildplan.Plan{
+				Provides: []buildplan.Provided{{Name: modules.Dependency}},
+				Requires: []buildplan.Required{
+					{
+						Name:     modules.Node,
+						Version:  version,
+						Metadata: buildplan.Metadata{"build": true, "launch": true},
+					},
+					{
+						Name:     modules.Dependency,
+						Metadata: buildplan.Metadata{"launch": true},
+					},
 				},
 			}))
 
@@ -65,19 +69,53 @@ func testDetect(t *testing.T, when spec.G, it spec.S) {
 
 			Expect(code).To(Equal(detect.PassStatusCode))
 
-			Expect(factory.Output).To(Equal(buildplan.BuildPlan{
-				node.Dependency: buildplan.Dependency{
-					Version:  "",
-					Metadata: buildplan.Metadata{"build": true, "launch": true},
-				},
-				modules.Dependency: buildplan.Dependency{
-					Metadata: buildplan.Metadata{"launch": true},
+			Expect(factory.Plans.Plan).To(Equal(buildplan.Plan{
+				Provides: []buildplan.Provided{{Name: modules.Dependency}},
+				Requires: []buildplan.Required{
+					{
+						Name:     modules.Node,
+						Metadata: buildplan.Metadata{"build": true, "launch": true},
+					},
+					{
+						Name:     modules.Dependency,
+						Metadata: buildplan.Metadata{"launch": true},
+					},
 				},
 			}))
 
 		})
 	})
 
+	when("there is a malformed package.json", func() {
+		it.Before(func() {
+			test.WriteFile(t, filepath.Join(factory.Detect.Application.Root, "package.json"), "{\n  \"engines\": }")
+		})
+
+		it("should pass and defer the parse error to build", func() {
+			code, err := runDetect(factory.Detect)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(code).To(Equal(detect.PassStatusCode))
+
+			Expect(factory.Plans.Plan).To(Equal(buildplan.Plan{
+				Provides: []buildplan.Provided{{Name: modules.Dependency}},
+				Requires: []buildplan.Required{
+					{
+						Name:     modules.Node,
+						Metadata: buildplan.Metadata{"build": true, "launch": true},
+					},
+					{
+						Name: modules.Dependency,
+						Metadata: buildplan.Metadata{
+							"launch":                 true,
+							modules.PackageJSONError: "line 2, column 14: invalid character '}' looking for beginning of value",
+						},
+					},
+				},
+			}))
+		})
+	})
+
 	when("there is no package.json", func() {
 		it("should fail", func() {
 			code, err := runDetect(factory.Detect)
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+)
+
+const defaultStack = "io.buildpacks.stacks.bionic"
+
+// options configure a local detect and build of an application
+type options struct {
+	app       string
+	buildpack string
+	layers    string
+	platform  string
+	stack     string
+	runs      int
+	stdout    io.Writer
+	stderr    io.Writer
+}
+
+func main() {
+	o := options{stdout: os.Stdout, stderr: os.Stderr}
+
+	flag.StringVar(&o.app, "app", ".", "application directory to build; it is copied, never modified")
+	flag.StringVar(&o.buildpack, "buildpack", "", "packaged buildpack directory (default: compile this buildpack)")
+	flag.StringVar(&o.layers, "layers", "", "layers directory to reuse between invocations (default: a new temporary directory)")
+	flag.StringVar(&o.platform, "platform", "", "platform directory (default: an empty temporary directory)")
+	flag.StringVar(&o.stack, "stack", defaultStack, "stack id passed to the buildpack")
+	flag.IntVar(&o.runs, "runs", 1, "number of builds to run against the same layers, to exercise cache reuse")
+	flag.Parse()
+
+	if err := run(o); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(o options) error {
+	if o.buildpack == "" {
+		buildpack, err := compile()
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(buildpack)
+		o.buildpack = buildpack
+	}
+
+	if o.platform == "" {
+		platform, err := ioutil.TempDir("", "platform")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(platform)
+
+		if err := os.MkdirAll(filepath.Join(platform, "env"), 0755); err != nil {
+			return err
+		}
+		o.platform = platform
+	}
+
+	if o.layers == "" {
+		layers, err := ioutil.TempDir("", "layers")
+		if err != nil {
+			return err
+		}
+		o.layers = layers
+	}
+
+	for i := 1; i <= o.runs; i++ {
+		_, _ = fmt.Fprintf(o.stdout, "===> Run %d of %d\n", i, o.runs)
+
+		if err := runOnce(o); err != nil {
+			return err
+		}
+	}
+
+	_, _ = fmt.Fprintf(o.stdout, "Layers left in %s\n", o.layers)
+	return nil
+}
+
+func runOnce(o options) error {
+	workspace, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workspace)
+
+	if err := helper.CopyDirectory(o.app, workspace); err != nil {
+		return fmt.Errorf("unable to copy application: %s", err.Error())
+	}
+
+	plans, err := ioutil.TempDir("", "plans")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(plans)
+
+	detectPlan := filepath.Join(plans, "plan.toml")
+	buildpackPlan := filepath.Join(plans, "buildpack-plan.toml")
+
+	_, _ = fmt.Fprintln(o.stdout, "===> DETECTING")
+	code, err := execute(o, workspace, filepath.Join(o.buildpack, "bin", "detect"), o.platform, detectPlan)
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("detect failed with status code %d", code)
+	}
+
+	plan, err := resolvePlan(detectPlan)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(buildpackPlan, plan, 0644); err != nil {
+		return err
+	}
+
+	section(o.stdout, "Build Plan", plan)
+
+	_, _ = fmt.Fprintln(o.stdout, "===> BUILDING")
+	code, err = execute(o, workspace, filepath.Join(o.buildpack, "bin", "build"), o.layers, o.platform, buildpackPlan)
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("build failed with status code %d", code)
+	}
+
+	return printLayers(o.stdout, o.layers)
+}
+
+// execute runs a buildpack executable the way the lifecycle does, returning its exit code
+func execute(o options, workspace string, bin string, args ...string) (int, error) {
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = workspace
+	cmd.Stdout = o.stdout
+	cmd.Stderr = o.stderr
+	cmd.Env = append(os.Environ(), "CNB_STACK_ID="+o.stack)
+
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode(), nil
+		}
+
+		return 0, fmt.Errorf("unable to run %s: %s", bin, err.Error())
+	}
+
+	return 0, nil
+}
+
+// resolvePlan turns the plan written by detect into the buildpack plan passed to build. Run on its own the
+// buildpack is the only member of its group, so it is given the entries it both requires and provides; requirements
+// such as node are left to the engine buildpack and are not checked here.
+func resolvePlan(detectPlan string) ([]byte, error) {
+	var plan struct {
+		Provides []struct {
+			Name string `toml:"name"`
+		} `toml:"provides"`
+		Requires []planEntry `toml:"requires"`
+	}
+
+	if exists, err := helper.FileExists(detectPlan); err != nil {
+		return nil, err
+	} else if exists {
+		if _, err := toml.DecodeFile(detectPlan, &plan); err != nil {
+			return nil, fmt.Errorf("unable to parse build plan: %s", err.Error())
+		}
+	}
+
+	provided := map[string]bool{}
+	for _, p := range plan.Provides {
+		provided[p.Name] = true
+	}
+
+	var buildpackPlan struct {
+		Entries []planEntry `toml:"entries"`
+	}
+
+	for _, r := range plan.Requires {
+		if provided[r.Name] {
+			buildpackPlan.Entries = append(buildpackPlan.Entries, r)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(buildpackPlan); err != nil {
+		return nil, fmt.Errorf("unable to write buildpack plan: %s", err.Error())
+	}
+
+	return buf.Bytes(), nil
+}
+
+type planEntry struct {
+	Name     string                 `toml:"name"`
+	Version  string                 `toml:"version,omitempty"`
+	Metadata map[string]interface{} `toml:"metadata,omitempty"`
+}
+
+// printLayers prints the layer metadata, env files, profile scripts and launch.toml in the layers directory
+func printLayers(w io.Writer, layers string) error {
+	var files []string
+
+	err := filepath.Walk(layers, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(layers, path)
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(rel, string(filepath.Separator))
+		switch {
+		case info.IsDir():
+			if len(parts) == 2 && !strings.HasPrefix(parts[1], "env") && parts[1] != "profile.d" {
+				return filepath.SkipDir
+			}
+		case len(parts) == 1 && strings.HasSuffix(rel, ".toml"):
+			files = append(files, rel)
+		case len(parts) == 3:
+			files = append(files, rel)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(files)
+	for _, f := range files {
+		buf, err := ioutil.ReadFile(filepath.Join(layers, f))
+		if err != nil {
+			return err
+		}
+
+		section(w, f, buf)
+	}
+
+	return nil
+}
+
+func section(w io.Writer, title string, content []byte) {
+	_, _ = fmt.Fprintf(w, "--- %s\n%s\n", title, strings.TrimRight(string(content), "\n"))
+}
+
+// compile builds this buildpack into a temporary directory laid out like a packaged buildpack
+func compile() (string, error) {
+	root, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir("", "buildpack")
+	if err != nil {
+		return "", err
+	}
+
+	if err := helper.CopyFile(filepath.Join(root, "buildpack.toml"), filepath.Join(dir, "buildpack.toml")); err != nil {
+		return "", fmt.Errorf("unable to copy buildpack.toml, run from the repository root: %s", err.Error())
+	}
+
+	for _, b := range []string{"detect", "build"} {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(dir, "bin", b), "./cmd/"+b)
+		cmd.Dir = root
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("unable to build %s: %s", b, err.Error())
+		}
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitLocal(t *testing.T) {
+	spec.Run(t, "Local", testLocal, spec.Report(report.Terminal{}))
+}
+
+func testLocal(t *testing.T, when spec.G, it spec.S) {
+	var (
+		o         options
+		stdout    *bytes.Buffer
+		buildpack string
+	)
+
+	it.Before(func() {
+		RegisterTestingT(t)
+
+		var err error
+		buildpack, err = ioutil.TempDir("", "buildpack")
+		Expect(err).NotTo(HaveOccurred())
+
+		app, err := ioutil.TempDir("", "app")
+		Expect(err).NotTo(HaveOccurred())
+		test.WriteFile(t, filepath.Join(app, "package.json"), "{}")
+
+		layers, err := ioutil.TempDir("", "layers")
+		Expect(err).NotTo(HaveOccurred())
+
+		stdout = &bytes.Buffer{}
+		o = options{app: app, buildpack: buildpack, layers: layers, stack: defaultStack, runs: 1, stdout: stdout, stderr: ioutil.Discard}
+
+		test.WriteFile(t, filepath.Join(buildpack, "bin", "detect"), `#!/usr/bin/env bash
+[[ -f package.json ]] || exit 100
+cat > "$2" <<PLAN
+[[provides]]
+name = "modules"
+
+[[requires]]
+name = "node"
+
+[[requires]]
+name = "modules"
+[requires.metadata]
+launch = true
+PLAN
+`)
+		test.WriteFile(t, filepath.Join(buildpack, "bin", "build"), `#!/usr/bin/env bash
+set -e
+plan=$(tr '\n' ' ' < "$3")
+count=$(cat "$1/modules/count" 2>/dev/null || echo 0)
+mkdir -p "$1/modules/env.launch" "$1/modules/node_modules"
+echo $((count + 1)) > "$1/modules/count"
+echo "$1/modules/node_modules" > "$1/modules/env.launch/NODE_PATH.override"
+echo "plan: $plan" > "$1/modules.toml"
+echo '[[processes]]' > "$1/launch.toml"
+touch package.json.built
+`)
+		Expect(os.Chmod(filepath.Join(buildpack, "bin", "detect"), 0755)).To(Succeed())
+		Expect(os.Chmod(filepath.Join(buildpack, "bin", "build"), 0755)).To(Succeed())
+	})
+
+	it.After(func() {
+		Expect(os.RemoveAll(buildpack)).To(Succeed())
+		Expect(os.RemoveAll(o.app)).To(Succeed())
+		Expect(os.RemoveAll(o.layers)).To(Succeed())
+	})
+
+	it("runs detect and build and prints the results", func() {
+		Expect(run(o)).To(Succeed())
+
+		Expect(stdout.String()).To(ContainSubstring("--- Build Plan\n[[entries]]"))
+		Expect(stdout.String()).To(ContainSubstring(`name = "modules"`))
+		Expect(stdout.String()).NotTo(ContainSubstring(`name = "node"`))
+		Expect(stdout.String()).To(ContainSubstring("--- modules.toml\nplan: [[entries]]"))
+		Expect(stdout.String()).To(ContainSubstring("--- launch.toml\n[[processes]]"))
+		Expect(stdout.String()).To(ContainSubstring(filepath.Join("modules", "env.launch", "NODE_PATH.override")))
+		Expect(stdout.String()).NotTo(ContainSubstring(filepath.Join("modules", "count")))
+
+		Expect(filepath.Join(o.app, "package.json.built")).NotTo(BeAnExistingFile())
+	})
+
+	it("reuses layers between runs", func() {
+		o.runs = 2
+		Expect(run(o)).To(Succeed())
+
+		Expect(stdout.String()).To(ContainSubstring("===> Run 2 of 2"))
+		Expect(ioutil.ReadFile(filepath.Join(o.layers, "modules", "count"))).To(Equal([]byte("2\n")))
+	})
+
+	it("fails when detect fails", func() {
+		Expect(os.Remove(filepath.Join(o.app, "package.json"))).To(Succeed())
+
+		Expect(run(o)).To(MatchError("detect failed with status code 100"))
+	})
+}
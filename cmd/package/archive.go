@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	indexMediaType    = "application/vnd.oci.image.index.v1+json"
+	manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	configMediaType   = "application/vnd.oci.image.config.v1+json"
+	layerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	buildpackageLabel = "io.buildpacks.buildpackage.metadata"
+	layersLabel       = "io.buildpacks.buildpack.layers"
+)
+
+// file is an entry in a packaged archive
+type file struct {
+	name    string
+	content []byte
+	mode    int64
+}
+
+// image is the buildpackage image for one platform
+type image struct {
+	os    string
+	arch  string
+	files []file
+}
+
+type descriptorJSON struct {
+	MediaType string        `json:"mediaType"`
+	Digest    string        `json:"digest"`
+	Size      int           `json:"size"`
+	Platform  *platformJSON `json:"platform,omitempty"`
+}
+
+type platformJSON struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// tarball writes files, and the directories that contain them, under prefix with fixed ownership and times so the
+// same inputs always produce the same bytes
+func tarball(files []file, prefix string, mtime time.Time) ([]byte, error) {
+	entries := map[string]file{}
+	for _, f := range files {
+		name := path.Join(prefix, f.name)
+		entries[name] = f
+
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			entries[dir+"/"] = file{mode: 0755}
+		}
+	}
+
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+
+	for _, name := range names {
+		f := entries[name]
+
+		header := &tar.Header{
+			Name:    name,
+			Mode:    f.mode,
+			ModTime: mtime,
+		}
+
+		if strings.HasSuffix(name, "/") {
+			header.Typeflag = tar.TypeDir
+		} else {
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(f.content))
+		}
+
+		if err := w.WriteHeader(header); err != nil {
+			return nil, err
+		}
+
+		if _, err := w.Write(f.content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// compress gzips content without a file name or modification time in the header
+func compress(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func tgz(files []file, prefix string, mtime time.Time) ([]byte, error) {
+	t, err := tarball(files, prefix, mtime)
+	if err != nil {
+		return nil, err
+	}
+
+	return compress(t)
+}
+
+// buildpackage writes an OCI image layout holding one buildpackage image per platform, each with the buildpack in a
+// single layer at the path the lifecycle expects
+func buildpackage(d descriptor, images []image, mtime time.Time) ([]byte, error) {
+	blobs := map[string][]byte{}
+	add := func(content []byte) string {
+		sum := digest(content)
+		blobs[sum] = content
+		return "sha256:" + sum
+	}
+
+	prefix := path.Join("cnb", "buildpacks", strings.Replace(d.Buildpack.ID, "/", "_", -1), d.Buildpack.Version)
+
+	var stacks []map[string]string
+	for _, s := range d.Stacks {
+		stacks = append(stacks, map[string]string{"id": s.ID})
+	}
+
+	var manifests []descriptorJSON
+	for _, i := range images {
+		layer, err := tarball(i.files, prefix, mtime)
+		if err != nil {
+			return nil, err
+		}
+
+		compressed, err := compress(layer)
+		if err != nil {
+			return nil, err
+		}
+
+		diffID := "sha256:" + digest(layer)
+
+		metadata, err := json.Marshal(map[string]interface{}{
+			"id":      d.Buildpack.ID,
+			"version": d.Buildpack.Version,
+			"stacks":  stacks,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		layers, err := json.Marshal(map[string]interface{}{
+			d.Buildpack.ID: map[string]interface{}{
+				d.Buildpack.Version: map[string]interface{}{
+					"api":         d.API,
+					"stacks":      stacks,
+					"layerDiffID": diffID,
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		config, err := json.Marshal(map[string]interface{}{
+			"architecture": i.arch,
+			"os":           i.os,
+			"created":      mtime.Format(time.RFC3339),
+			"config": map[string]interface{}{
+				"Labels": map[string]string{
+					buildpackageLabel: string(metadata),
+					layersLabel:       string(layers),
+				},
+			},
+			"rootfs": map[string]interface{}{
+				"type":     "layers",
+				"diff_ids": []string{diffID},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		manifest, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     manifestMediaType,
+			"config":        descriptorJSON{MediaType: configMediaType, Digest: add(config), Size: len(config)},
+			"layers":        []descriptorJSON{{MediaType: layerMediaType, Digest: add(compressed), Size: len(compressed)}},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		manifests = append(manifests, descriptorJSON{
+			MediaType: manifestMediaType,
+			Digest:    add(manifest),
+			Size:      len(manifest),
+			Platform:  &platformJSON{Architecture: i.arch, OS: i.os},
+		})
+	}
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     indexMediaType,
+		"manifests":     manifests,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := []file{
+		{name: "oci-layout", content: []byte(`{"imageLayoutVersion":"1.0.0"}`), mode: 0644},
+		{name: "index.json", content: index, mode: 0644},
+	}
+
+	for sum, content := range blobs {
+		files = append(files, file{name: path.Join("blobs", "sha256", sum), content: content, mode: 0644})
+	}
+
+	layout, err := tarball(files, "", mtime)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write buildpackage: %s", err.Error())
+	}
+
+	return layout, nil
+}
+
+func digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
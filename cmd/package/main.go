@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	artifactName  = "npm-cnb"
+	checksumsFile = "checksums.txt"
+	dependencies  = "dependencies.json"
+	defaultArch   = "amd64"
+)
+
+var binaries = []string{"detect", "build"}
+
+// options configure a packaging run
+type options struct {
+	root    string
+	output  string
+	version string
+	os      string
+	arches  []string
+	mtime   time.Time
+	stdout  io.Writer
+
+	// dir also unpacks the package for the host architecture, or the first target, into the output directory, for use
+	// with pack build --buildpack
+	dir bool
+
+	// compile builds the named binary for an os and architecture into out
+	compile func(root, goos, goarch, binary, out string) error
+
+	// modules lists the Go modules, other than the buildpack itself, compiled into the binaries
+	modules func(root string) ([]module, error)
+}
+
+// module is a Go module recorded in the package's dependency metadata
+type module struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// descriptor is the subset of buildpack.toml the package metadata is derived from
+type descriptor struct {
+	API       string `toml:"api"`
+	Buildpack struct {
+		ID      string `toml:"id"`
+		Version string `toml:"version"`
+	} `toml:"buildpack"`
+	Stacks []struct {
+		ID string `toml:"id"`
+	} `toml:"stacks"`
+	Targets []struct {
+		OS   string `toml:"os"`
+		Arch string `toml:"arch"`
+	} `toml:"targets"`
+}
+
+func main() {
+	o := options{stdout: os.Stdout, compile: compile, modules: goModules}
+
+	var arches string
+	flag.StringVar(&o.root, "root", ".", "repository root containing buildpack.toml")
+	flag.StringVar(&o.output, "output", "dist", "directory the packaged artifacts are written to")
+	flag.StringVar(&o.version, "version", "", "buildpack version (default: the version in buildpack.toml)")
+	flag.StringVar(&o.os, "os", "linux", "target operating system")
+	flag.StringVar(&arches, "arch", "", "comma separated target architectures (default: the targets in buildpack.toml)")
+	flag.BoolVar(&o.dir, "dir", false, "also unpack the package for the host architecture and print \"Buildpack packaged into: <dir>\"")
+	flag.Parse()
+
+	if arches != "" {
+		o.arches = strings.Split(arches, ",")
+	}
+
+	mtime, err := sourceDate(os.Getenv("SOURCE_DATE_EPOCH"))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	o.mtime = mtime
+
+	if err := run(o); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(o options) error {
+	buf, err := ioutil.ReadFile(filepath.Join(o.root, "buildpack.toml"))
+	if err != nil {
+		return fmt.Errorf("unable to read buildpack.toml: %s", err.Error())
+	}
+
+	if o.version != "" {
+		if buf, err = setVersion(buf, o.version); err != nil {
+			return err
+		}
+	}
+
+	var d descriptor
+	if _, err := toml.Decode(string(buf), &d); err != nil {
+		return fmt.Errorf("unable to parse buildpack.toml: %s", err.Error())
+	}
+
+	deps, err := o.dependencies()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(o.output, 0755); err != nil {
+		return err
+	}
+
+	var (
+		artifacts []string
+		images    []image
+	)
+
+	for _, arch := range o.targets(d) {
+		files := []file{
+			{name: "buildpack.toml", content: buf, mode: 0644},
+			{name: dependencies, content: deps, mode: 0644},
+		}
+
+		for _, b := range binaries {
+			bin, err := o.binary(b, arch)
+			if err != nil {
+				return err
+			}
+			files = append(files, file{name: filepath.ToSlash(filepath.Join("bin", b)), content: bin, mode: 0755})
+		}
+
+		archive, err := tgz(files, "", o.mtime)
+		if err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("%s-%s-%s-%s.tgz", artifactName, d.Buildpack.Version, o.os, arch)
+		if err := o.write(name, archive); err != nil {
+			return err
+		}
+		artifacts = append(artifacts, name)
+
+		images = append(images, image{os: o.os, arch: arch, files: files})
+	}
+
+	if o.dir {
+		if err := o.unpack(d, images); err != nil {
+			return err
+		}
+	}
+
+	layout, err := buildpackage(d, images, o.mtime)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.oci.tar", artifactName, d.Buildpack.Version)
+	if err := o.write(name, layout); err != nil {
+		return err
+	}
+	artifacts = append(artifacts, name)
+
+	return o.checksums(artifacts)
+}
+
+// targets returns the architectures to package, defaulting to those buildpack.toml declares for the os
+func (o options) targets(d descriptor) []string {
+	if len(o.arches) > 0 {
+		return o.arches
+	}
+
+	var arches []string
+	for _, t := range d.Targets {
+		if t.OS == o.os {
+			arches = append(arches, t.Arch)
+		}
+	}
+
+	if len(arches) == 0 {
+		return []string{defaultArch}
+	}
+
+	return arches
+}
+
+// unpack writes the files of the image for the host architecture, or the first image when the host's is not packaged,
+// into a directory of the output. The line it prints is what integration tests look for.
+func (o options) unpack(d descriptor, images []image) error {
+	i := images[0]
+	for _, candidate := range images {
+		if candidate.arch == runtime.GOARCH {
+			i = candidate
+		}
+	}
+
+	dir, err := filepath.Abs(filepath.Join(o.output, fmt.Sprintf("%s-%s-%s-%s", artifactName, d.Buildpack.Version, i.os, i.arch)))
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	for _, f := range i.files {
+		path := filepath.Join(dir, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(path, f.content, os.FileMode(f.mode)); err != nil {
+			return fmt.Errorf("unable to write %s: %s", path, err.Error())
+		}
+	}
+
+	_, _ = fmt.Fprintf(o.stdout, "Buildpack packaged into: %s\n", dir)
+	return nil
+}
+
+// binary compiles a buildpack executable and returns its contents
+func (o options) binary(name, arch string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "package")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, name)
+	if err := o.compile(o.root, o.os, arch, name, out); err != nil {
+		return nil, fmt.Errorf("unable to build %s for %s/%s: %s", name, o.os, arch, err.Error())
+	}
+
+	return ioutil.ReadFile(out)
+}
+
+// dependencies returns the JSON dependency metadata shipped in the package
+func (o options) dependencies() ([]byte, error) {
+	modules, err := o.modules(o.root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list Go modules: %s", err.Error())
+	}
+
+	deps := append([]module{}, modules...)
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Path < deps[j].Path })
+
+	buf, err := json.MarshalIndent(deps, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(buf, '\n'), nil
+}
+
+func (o options) write(name string, content []byte) error {
+	if err := ioutil.WriteFile(filepath.Join(o.output, name), content, 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %s", name, err.Error())
+	}
+
+	_, _ = fmt.Fprintf(o.stdout, "Packaged %s\n", filepath.Join(o.output, name))
+	return nil
+}
+
+// checksums writes a sha256sum compatible manifest of the artifacts
+func (o options) checksums(artifacts []string) error {
+	sort.Strings(artifacts)
+
+	var buf bytes.Buffer
+	for _, a := range artifacts {
+		content, err := ioutil.ReadFile(filepath.Join(o.output, a))
+		if err != nil {
+			return err
+		}
+
+		_, _ = fmt.Fprintf(&buf, "%s  %s\n", digest(content), a)
+	}
+
+	return o.write(checksumsFile, buf.Bytes())
+}
+
+var versionPattern = regexp.MustCompile(`(?m)^(\s*version\s*=\s*)"[^"]*"`)
+
+// setVersion replaces the version in the [buildpack] table of buildpack.toml, leaving the rest of the file as written
+func setVersion(buf []byte, version string) ([]byte, error) {
+	start := bytes.Index(buf, []byte("[buildpack]"))
+	if start < 0 {
+		return nil, fmt.Errorf("unable to find [buildpack] in buildpack.toml")
+	}
+
+	table := buf[start:]
+	if end := regexp.MustCompile(`(?m)^\s*\[`).FindIndex(table[len("[buildpack]"):]); end != nil {
+		table = table[:len("[buildpack]")+end[0]]
+	}
+
+	loc := versionPattern.FindSubmatchIndex(table)
+	if loc == nil {
+		return nil, fmt.Errorf("unable to find the buildpack version in buildpack.toml")
+	}
+
+	var out bytes.Buffer
+	out.Write(buf[:start+loc[3]])
+	out.WriteString(strconv.Quote(version))
+	out.Write(buf[start+loc[1]:])
+
+	return out.Bytes(), nil
+}
+
+func sourceDate(epoch string) (time.Time, error) {
+	if epoch == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse SOURCE_DATE_EPOCH: %s", err.Error())
+	}
+
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// compile builds a binary without paths, build ids or cgo so identical sources produce identical bytes
+func compile(root, goos, goarch, binary, out string) error {
+	cmd := exec.Command("go", "build", "-trimpath", "-ldflags", "-s -w -buildid=", "-o", out, "./cmd/"+binary)
+	cmd.Dir = root
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch, "CGO_ENABLED=0")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+func goModules(root string) ([]module, error) {
+	cmd := exec.Command("go", "list", "-m", "-json", "all")
+	cmd.Dir = root
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var modules []module
+	decoder := json.NewDecoder(bytes.NewReader(out))
+	for decoder.More() {
+		var m struct {
+			module
+			Main bool
+		}
+		if err := decoder.Decode(&m); err != nil {
+			return nil, err
+		}
+
+		// The buildpack itself is the main module and is identified by buildpack.toml instead
+		if !m.Main {
+			modules = append(modules, m.module)
+		}
+	}
+
+	return modules, nil
+}
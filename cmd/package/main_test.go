@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitPackage(t *testing.T) {
+	spec.Run(t, "Package", testPackage, spec.Report(report.Terminal{}))
+}
+
+func testPackage(t *testing.T, when spec.G, it spec.S) {
+	var o options
+
+	it.Before(func() {
+		RegisterTestingT(t)
+
+		root, err := ioutil.TempDir("", "root")
+		Expect(err).NotTo(HaveOccurred())
+
+		output, err := ioutil.TempDir("", "output")
+		Expect(err).NotTo(HaveOccurred())
+
+		test.WriteFile(t, filepath.Join(root, "buildpack.toml"), `api = "0.2"
+
+[buildpack]
+id = "org.cloudfoundry.buildpacks.npm"
+name = "NPM Buildpack"
+version = "0.0.3"
+
+[[stacks]]
+id = "io.buildpacks.stacks.bionic"
+
+[[targets]]
+os = "linux"
+arch = "amd64"
+
+[[targets]]
+os = "linux"
+arch = "arm64"
+
+[[targets]]
+os = "windows"
+arch = "amd64"
+`)
+
+		o = options{
+			root:   root,
+			output: output,
+			os:     "linux",
+			arches: []string{"amd64"},
+			mtime:  time.Unix(0, 0).UTC(),
+			stdout: ioutil.Discard,
+			compile: func(_, goos, goarch, binary, out string) error {
+				return ioutil.WriteFile(out, []byte(fmt.Sprintf("%s-%s-%s", binary, goos, goarch)), 0755)
+			},
+			modules: func(string) ([]module, error) {
+				return []module{{Path: "github.com/sclevine/spec", Version: "v1.2.0"}, {Path: "github.com/BurntSushi/toml", Version: "v0.3.1"}}, nil
+			},
+		}
+	})
+
+	it.After(func() {
+		Expect(os.RemoveAll(o.root)).To(Succeed())
+		Expect(os.RemoveAll(o.output)).To(Succeed())
+	})
+
+	it("packages buildpack.toml, the binaries and the dependency metadata", func() {
+		Expect(run(o)).To(Succeed())
+
+		files := untar(t, filepath.Join(o.output, "npm-cnb-0.0.3-linux-amd64.tgz"), true)
+		Expect(files).To(HaveKeyWithValue("bin/detect", "detect-linux-amd64"))
+		Expect(files).To(HaveKeyWithValue("bin/build", "build-linux-amd64"))
+		Expect(files).To(HaveKeyWithValue("buildpack.toml", ContainSubstring(`version = "0.0.3"`)))
+		Expect(files).To(HaveKeyWithValue(dependencies, MatchJSON(`[
+			{"path": "github.com/BurntSushi/toml", "version": "v0.3.1"},
+			{"path": "github.com/sclevine/spec", "version": "v1.2.0"}
+		]`)))
+	})
+
+	it("overrides the version", func() {
+		o.version = "1.2.3"
+		Expect(run(o)).To(Succeed())
+
+		files := untar(t, filepath.Join(o.output, "npm-cnb-1.2.3-linux-amd64.tgz"), true)
+		Expect(files).To(HaveKeyWithValue("buildpack.toml", ContainSubstring(`version = "1.2.3"`)))
+		Expect(files).To(HaveKeyWithValue("buildpack.toml", ContainSubstring(`name = "NPM Buildpack"`)))
+	})
+
+	it("packages each architecture", func() {
+		o.arches = []string{"amd64", "arm64"}
+		Expect(run(o)).To(Succeed())
+
+		files := untar(t, filepath.Join(o.output, "npm-cnb-0.0.3-linux-arm64.tgz"), true)
+		Expect(files).To(HaveKeyWithValue("bin/detect", "detect-linux-arm64"))
+
+		layout := untar(t, filepath.Join(o.output, "npm-cnb-0.0.3.oci.tar"), false)
+		Expect(layout).To(HaveKeyWithValue("oci-layout", `{"imageLayoutVersion":"1.0.0"}`))
+
+		var index struct {
+			Manifests []descriptorJSON `json:"manifests"`
+		}
+		Expect(json.Unmarshal([]byte(layout["index.json"]), &index)).To(Succeed())
+		Expect(index.Manifests).To(HaveLen(2))
+
+		for i, arch := range o.arches {
+			Expect(index.Manifests[i].Platform).To(Equal(&platformJSON{Architecture: arch, OS: "linux"}))
+
+			var manifest struct {
+				Config descriptorJSON   `json:"config"`
+				Layers []descriptorJSON `json:"layers"`
+			}
+			Expect(json.Unmarshal([]byte(blob(layout, index.Manifests[i].Digest)), &manifest)).To(Succeed())
+			Expect(blob(layout, manifest.Config.Digest)).To(ContainSubstring(buildpackageLabel))
+
+			layer := filepath.Join(o.output, "layer.tgz")
+			Expect(ioutil.WriteFile(layer, []byte(blob(layout, manifest.Layers[0].Digest)), 0644)).To(Succeed())
+			Expect(untar(t, layer, true)).To(HaveKeyWithValue(
+				"cnb/buildpacks/org.cloudfoundry.buildpacks.npm/0.0.3/bin/detect", "detect-linux-"+arch))
+		}
+	})
+
+	it("unpacks the package for the host architecture into a directory", func() {
+		var stdout bytes.Buffer
+		o.stdout = &stdout
+		o.arches = []string{"ppc64", runtime.GOARCH}
+		o.dir = true
+		Expect(run(o)).To(Succeed())
+
+		dir := filepath.Join(o.output, "npm-cnb-0.0.3-linux-"+runtime.GOARCH)
+		Expect(stdout.String()).To(ContainSubstring("Buildpack packaged into: " + dir + "\n"))
+		Expect(ioutil.ReadFile(filepath.Join(dir, "bin", "build"))).To(Equal([]byte("build-linux-" + runtime.GOARCH)))
+		Expect(filepath.Join(dir, "buildpack.toml")).To(BeARegularFile())
+
+		info, err := os.Stat(filepath.Join(dir, "bin", "detect"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+	})
+
+	it("defaults to the targets in buildpack.toml", func() {
+		o.arches = nil
+		Expect(run(o)).To(Succeed())
+
+		Expect(filepath.Join(o.output, "npm-cnb-0.0.3-linux-amd64.tgz")).To(BeARegularFile())
+		Expect(filepath.Join(o.output, "npm-cnb-0.0.3-linux-arm64.tgz")).To(BeARegularFile())
+		Expect(filepath.Join(o.output, "npm-cnb-0.0.3-windows-amd64.tgz")).NotTo(BeAnExistingFile())
+	})
+
+	it("writes checksums of the artifacts", func() {
+		Expect(run(o)).To(Succeed())
+
+		archive, err := ioutil.ReadFile(filepath.Join(o.output, "npm-cnb-0.0.3-linux-amd64.tgz"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ioutil.ReadFile(filepath.Join(o.output, checksumsFile))).To(ContainSubstring(
+			fmt.Sprintf("%s  npm-cnb-0.0.3-linux-amd64.tgz\n", digest(archive))))
+	})
+
+	it("is reproducible", func() {
+		Expect(run(o)).To(Succeed())
+		first, err := ioutil.ReadFile(filepath.Join(o.output, checksumsFile))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.RemoveAll(o.output)).To(Succeed())
+		Expect(run(o)).To(Succeed())
+
+		Expect(ioutil.ReadFile(filepath.Join(o.output, checksumsFile))).To(Equal(first))
+	})
+
+	it("fails when a binary does not compile", func() {
+		o.compile = func(_, _, _, _, _ string) error { return fmt.Errorf("exit status 2") }
+
+		Expect(run(o)).To(MatchError("unable to build detect for linux/amd64: exit status 2"))
+	})
+}
+
+func blob(layout map[string]string, digest string) string {
+	return layout[filepath.Join("blobs", "sha256", digest[len("sha256:"):])]
+}
+
+// untar returns the regular files in an archive, keyed by name
+func untar(t *testing.T, archive string, compressed bool) map[string]string {
+	t.Helper()
+
+	f, err := os.Open(archive)
+	Expect(err).NotTo(HaveOccurred())
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		r, err = gzip.NewReader(f)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		Expect(err).NotTo(HaveOccurred())
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, tr)
+		Expect(err).NotTo(HaveOccurred())
+
+		files[header.Name] = buf.String()
+	}
+
+	return files
+}
@@ -0,0 +1,389 @@
+// Package fakenpm is a Runner that behaves like the npm and node CLIs against a registry directory, so that builds
+// can be exercised without Node.js or network access.
+package fakenpm
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+	"github.com/cloudfoundry/npm-cnb/modules"
+)
+
+// DefaultABI is reported by `node -p process.versions.modules` unless Runner.ABI is set
+const DefaultABI = "64"
+
+// Runner serves packages from Registry, which holds one directory per package version laid out as
+// <name>/<version>/, e.g. leftpad/0.0.1/package.json.
+type Runner struct {
+	Registry string
+	ABI      string
+
+	mutex   sync.Mutex
+	calls   [][]string
+	scripts []string
+}
+
+func (r *Runner) Run(bin, dir string, args ...string) error {
+	_, err := r.RunWithOutput(bin, dir, args...)
+	return err
+}
+
+func (r *Runner) RunWithOutput(bin, dir string, args ...string) (string, error) {
+	r.mutex.Lock()
+	r.calls = append(r.calls, append([]string{bin}, args...))
+	r.mutex.Unlock()
+
+	switch {
+	case bin == "node" && len(args) == 2 && args[0] == "-p" && args[1] == "process.versions.modules":
+		if r.ABI == "" {
+			return DefaultABI + "\n", nil
+		}
+		return r.ABI + "\n", nil
+	case bin != "npm" || len(args) == 0:
+		return "", fmt.Errorf("fakenpm: unsupported command: %s %s", bin, strings.Join(args, " "))
+	}
+
+	positional, flags := parseArgs(args[1:])
+
+	switch args[0] {
+	case "install", "ci":
+		return "", r.install(dir, flags)
+	case "rebuild":
+		return "", r.rebuild(dir, positional, flags)
+	case "run-script", "run":
+		if len(positional) == 1 {
+			return "", r.runScript(dir, positional[0])
+		}
+	case "cache":
+		if len(positional) == 1 && positional[0] == "verify" {
+			return "", os.MkdirAll(flags["cache"], 0777)
+		}
+	}
+
+	return "", fmt.Errorf("fakenpm: unsupported command: npm %s", strings.Join(args, " "))
+}
+
+// Calls returns every command run so far, each starting with the binary name
+func (r *Runner) Calls() [][]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([][]string(nil), r.calls...)
+}
+
+// Scripts returns the install scripts that would have run, and the app scripts run with `npm run-script`, as
+// "<package>:<script>"
+func (r *Runner) Scripts() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]string(nil), r.scripts...)
+}
+
+func (r *Runner) install(dir string, flags map[string]string) error {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "package-lock.json"))
+	if err != nil {
+		return fmt.Errorf("fakenpm: %s", err.Error())
+	}
+
+	packages, err := modules.ParseLockfile(buf)
+	if err != nil {
+		return fmt.Errorf("fakenpm: unable to parse package-lock.json: %s", err.Error())
+	}
+
+	for _, pkg := range packages {
+		target := filepath.Join(dir, filepath.FromSlash(pkg.Path))
+
+		if pkg.Link {
+			if err := r.link(dir, target, pkg); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if installed(target, pkg.Version) {
+			continue
+		}
+
+		if err := r.fetch(dir, target, pkg, flags["cache"]); err != nil {
+			return err
+		}
+
+		if _, ignore := flags["ignore-scripts"]; !ignore {
+			if err := r.runScripts(pkg.Name, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Runner) rebuild(dir string, names []string, flags map[string]string) error {
+	if _, ignore := flags["ignore-scripts"]; ignore {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "package-lock.json"))
+	if os.IsNotExist(err) {
+		buf = []byte("{}")
+	} else if err != nil {
+		return err
+	}
+
+	packages, err := modules.ParseLockfile(buf)
+	if err != nil {
+		return fmt.Errorf("fakenpm: unable to parse package-lock.json: %s", err.Error())
+	}
+
+	for _, pkg := range packages {
+		if len(names) > 0 && !contains(names, pkg.Name) {
+			continue
+		}
+
+		if err := r.runScripts(pkg.Name, filepath.Join(dir, filepath.FromSlash(pkg.Path))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runScript records one of the app's scripts, failing like npm does when the app does not define it
+func (r *Runner) runScript(dir, script string) error {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	scripts, _ := manifest["scripts"].(map[string]interface{})
+	if _, ok := scripts[script]; !ok {
+		return fmt.Errorf("fakenpm: missing script: %s", script)
+	}
+
+	name, _ := manifest["name"].(string)
+	if name == "" {
+		name = "."
+	}
+
+	r.mutex.Lock()
+	r.scripts = append(r.scripts, fmt.Sprintf("%s:%s", name, script))
+	r.mutex.Unlock()
+
+	return nil
+}
+
+func (r *Runner) fetch(dir, target string, pkg modules.LockfilePackage, npmCache string) error {
+	source := filepath.Join(r.Registry, filepath.FromSlash(pkg.Name), pkg.Version)
+	if exists, err := helper.FileExists(source); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("fakenpm: 404 Not Found - GET %s@%s", pkg.Name, pkg.Version)
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	if err := helper.CopyDirectory(source, target); err != nil {
+		return err
+	}
+
+	manifest, err := readManifest(target)
+	if err != nil {
+		return err
+	}
+
+	// npm 6 records where and from what each package was installed
+	manifest["_resolved"] = pkg.Resolved
+	manifest["_integrity"] = pkg.Integrity
+	manifest["_where"] = dir
+
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(target, "package.json"), buf, 0644); err != nil {
+		return err
+	}
+
+	if err := linkBins(dir, target, manifest); err != nil {
+		return err
+	}
+
+	if npmCache == "" {
+		return nil
+	}
+
+	return cache(npmCache, pkg, buf)
+}
+
+func (r *Runner) link(dir, target string, pkg modules.LockfilePackage) error {
+	source := modules.LocalSource(pkg)
+
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(target), filepath.Join(dir, filepath.FromSlash(source)))
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(rel, target)
+}
+
+func (r *Runner) runScripts(name, target string) error {
+	manifest, err := readManifest(target)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	scripts, _ := manifest["scripts"].(map[string]interface{})
+	for _, script := range []string{"preinstall", "install", "postinstall"} {
+		if _, ok := scripts[script]; ok {
+			r.mutex.Lock()
+			r.scripts = append(r.scripts, fmt.Sprintf("%s:%s", name, script))
+			r.mutex.Unlock()
+		}
+	}
+
+	return nil
+}
+
+func installed(target, version string) bool {
+	manifest, err := readManifest(target)
+	return err == nil && manifest["version"] == version
+}
+
+func readManifest(dir string) (map[string]interface{}, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := map[string]interface{}{}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return nil, fmt.Errorf("fakenpm: unable to parse %s: %s", filepath.Join(dir, "package.json"), err.Error())
+	}
+
+	return manifest, nil
+}
+
+func linkBins(dir, target string, manifest map[string]interface{}) error {
+	bins, _ := manifest["bin"].(map[string]interface{})
+
+	var names []string
+	for name := range bins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path, _ := bins[name].(string)
+		bin := filepath.Join(dir, modules.ModulesDir, ".bin", name)
+
+		if err := os.MkdirAll(filepath.Dir(bin), 0777); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(filepath.Dir(bin), filepath.Join(target, filepath.FromSlash(path)))
+		if err != nil {
+			return err
+		}
+
+		_ = os.Remove(bin)
+		if err := os.Symlink(rel, bin); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cache writes the package into npmCache the way npm's cacache would, keyed by its resolved URL
+func cache(npmCache string, pkg modules.LockfilePackage, content []byte) error {
+	sum := sha512.Sum512(content)
+	integrity := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	key := "make-fetch-happen:request-cache:" + pkg.Resolved
+	if pkg.Resolved == "" {
+		key = fmt.Sprintf("make-fetch-happen:request-cache:%s@%s", pkg.Name, pkg.Version)
+	}
+
+	contentPath := modules.ContentPath(npmCache, integrity)
+	if err := os.MkdirAll(filepath.Dir(contentPath), 0777); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(contentPath, content, 0644); err != nil {
+		return err
+	}
+
+	bucket := modules.IndexBucket(npmCache, key)
+	if err := os.MkdirAll(filepath.Dir(bucket), 0777); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(bucket, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "\n%s", modules.IndexLine(key, integrity, int64(len(content)), time.Now().UnixNano()/int64(time.Millisecond)))
+	return err
+}
+
+// parseArgs splits npm arguments into positional arguments and --flags, where --cache and --registry take a value
+func parseArgs(args []string) ([]string, map[string]string) {
+	var positional []string
+	flags := map[string]string{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name := strings.TrimPrefix(arg, "--")
+		if parts := strings.SplitN(name, "=", 2); len(parts) == 2 {
+			flags[parts[0]] = parts[1]
+		} else if (name == "cache" || name == "registry") && i+1 < len(args) {
+			flags[name] = args[i+1]
+			i++
+		} else {
+			flags[name] = ""
+		}
+	}
+
+	return positional, flags
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
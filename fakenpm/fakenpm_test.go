@@ -0,0 +1,118 @@
+package fakenpm_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/fakenpm"
+	"github.com/cloudfoundry/npm-cnb/modules"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+const lockfile = `{
+  "lockfileVersion": 1,
+  "dependencies": {
+    "leftpad": {"version": "0.0.1", "resolved": "https://registry.npmjs.org/leftpad/-/leftpad-0.0.1.tgz"},
+    "@cnb/scripted": {"version": "1.0.0", "resolved": "https://registry.npmjs.org/@cnb/scripted/-/scripted-1.0.0.tgz"}
+  }
+}`
+
+func TestUnitFakeNPM(t *testing.T) {
+	spec.Run(t, "FakeNPM", testFakeNPM, spec.Report(report.Terminal{}))
+}
+
+func testFakeNPM(t *testing.T, when spec.G, it spec.S) {
+	var (
+		runner   *fakenpm.Runner
+		location string
+		npmCache string
+	)
+
+	it.Before(func() {
+		RegisterTestingT(t)
+
+		var err error
+		location, err = ioutil.TempDir("", "fakenpm")
+		Expect(err).NotTo(HaveOccurred())
+
+		npmCache = filepath.Join(location, modules.CacheDir)
+		runner = &fakenpm.Runner{Registry: filepath.Join("..", "integration", "fixtures", "registry")}
+	})
+
+	it.After(func() {
+		Expect(os.RemoveAll(location)).To(Succeed())
+	})
+
+	when("installing", func() {
+		it.Before(func() {
+			test.WriteFile(t, filepath.Join(location, "package-lock.json"), lockfile)
+		})
+
+		it("creates node_modules from the lockfile and populates the cache", func() {
+			Expect(runner.Run("npm", location, "install", "--cache", npmCache)).To(Succeed())
+
+			Expect(filepath.Join(location, modules.ModulesDir, "leftpad", "index.js")).To(BeARegularFile())
+			Expect(filepath.Join(location, modules.ModulesDir, "@cnb", "scripted", "package.json")).To(BeARegularFile())
+			Expect(os.Readlink(filepath.Join(location, modules.ModulesDir, ".bin", "scripted"))).To(Equal(filepath.Join("..", "@cnb", "scripted", "bin", "scripted.js")))
+			Expect(filepath.Join(npmCache, "_cacache", "index-v5")).To(BeADirectory())
+
+			Expect(runner.Scripts()).To(Equal([]string{"@cnb/scripted:postinstall"}))
+		})
+
+		it("does not run install scripts when they are ignored", func() {
+			Expect(runner.Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache)).To(Succeed())
+
+			Expect(runner.Scripts()).To(BeEmpty())
+		})
+
+		it("fails for packages missing from the registry", func() {
+			test.WriteFile(t, filepath.Join(location, "package-lock.json"), `{"dependencies": {"missing": {"version": "1.0.0"}}}`)
+
+			Expect(runner.Run("npm", location, "install")).To(MatchError(ContainSubstring("404 Not Found - GET missing@1.0.0")))
+		})
+	})
+
+	when("rebuilding", func() {
+		it("runs install scripts for the named packages", func() {
+			test.WriteFile(t, filepath.Join(location, "package-lock.json"), lockfile)
+			Expect(runner.Run("npm", location, "install", "--ignore-scripts")).To(Succeed())
+
+			Expect(runner.Run("npm", location, "rebuild", "@cnb/scripted")).To(Succeed())
+			Expect(runner.Scripts()).To(Equal([]string{"@cnb/scripted:postinstall"}))
+		})
+	})
+
+	when("running an app script", func() {
+		it("records scripts the app defines", func() {
+			test.WriteFile(t, filepath.Join(location, "package.json"), `{"name": "app", "scripts": {"postinstall": "node build.js"}}`)
+
+			Expect(runner.Run("npm", location, "run-script", "postinstall")).To(Succeed())
+			Expect(runner.Scripts()).To(Equal([]string{"app:postinstall"}))
+
+			Expect(runner.Run("npm", location, "run-script", "prepare")).To(MatchError("fakenpm: missing script: prepare"))
+		})
+	})
+
+	when("asking node for its ABI", func() {
+		it("reports the configured ABI", func() {
+			Expect(runner.RunWithOutput("node", location, "-p", "process.versions.modules")).To(Equal(fakenpm.DefaultABI + "\n"))
+
+			runner.ABI = "72"
+			Expect(runner.RunWithOutput("node", location, "-p", "process.versions.modules")).To(Equal("72\n"))
+		})
+	})
+
+	it("records every call", func() {
+		Expect(runner.Run("npm", location, "cache", "verify", "--cache", npmCache)).To(Succeed())
+		Expect(runner.Calls()).To(Equal([][]string{{"npm", "cache", "verify", "--cache", npmCache}}))
+	})
+
+	it("rejects commands it does not understand", func() {
+		Expect(runner.Run("yarn", location, "install")).To(HaveOccurred())
+	})
+}
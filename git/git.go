@@ -0,0 +1,165 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+)
+
+// BindingType identifies the service binding holding the SSH key, and optionally the known_hosts, used to clone git
+// dependencies
+const BindingType = "git-ssh"
+
+const (
+	// PrivateKey and KnownHosts are the binding's entries, named as in a Kubernetes SSH auth secret
+	PrivateKey = "ssh-privatekey"
+	KnownHosts = "known_hosts"
+)
+
+type Runner interface {
+	Run(bin, dir string, args ...string) error
+	RunWithOutput(bin, dir string, args ...string) (string, error)
+}
+
+type Logger interface {
+	Info(format string, args ...interface{})
+}
+
+// Git clones the repositories that git dependencies are installed from
+type Git struct {
+	Runner Runner
+	Logger Logger
+}
+
+func (g Git) Mirror(url, dir, commit string) (bool, error) {
+	exists, err := helper.FileExists(dir)
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
+		if commit != "" && g.hasCommit(dir, commit) {
+			return false, nil
+		}
+
+		// The repository may be fetched from another of its URLs than it was cloned from
+		if err := g.Runner.Run("git", dir, "remote", "set-url", "--", "origin", url); err != nil {
+			return true, err
+		}
+
+		if err := g.Runner.Run("git", dir, "fetch", "--quiet", "--prune", "origin"); err != nil {
+			return true, err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+			return false, err
+		}
+
+		if err := g.Runner.Run("git", filepath.Dir(dir), "clone", "--quiet", "--mirror", "--", url, dir); err != nil {
+			return true, err
+		}
+	}
+
+	if commit != "" && !g.hasCommit(dir, commit) {
+		return true, fmt.Errorf("commit %s not found", commit)
+	}
+
+	return true, nil
+}
+
+func (g Git) hasCommit(dir, commit string) bool {
+	_, err := g.Runner.RunWithOutput("git", dir, "cat-file", "-e", commit+"^{commit}")
+	return err == nil
+}
+
+// ConfigureSSH returns the GIT_SSH_COMMAND that makes git use the SSH key from a binding of BindingType under one of
+// bindingRoots, copied into dir because ssh refuses keys other users can read, or "" when there is no binding. Without
+// a known_hosts in the binding, hosts must already be known to the stack.
+func ConfigureSSH(bindingRoots []string, dir string, logger Logger) (string, error) {
+	binding, err := findBinding(bindingRoots)
+	if err != nil || binding == "" {
+		return "", err
+	}
+
+	key, err := entry(binding, PrivateKey)
+	if err != nil {
+		return "", err
+	} else if key == "" {
+		return "", fmt.Errorf("%s binding %s has no %s", BindingType, binding, PrivateKey)
+	}
+
+	buf, err := ioutil.ReadFile(key)
+	if err != nil {
+		return "", err
+	}
+
+	identity := filepath.Join(dir, "id_git")
+	if err := ioutil.WriteFile(identity, buf, 0600); err != nil {
+		return "", fmt.Errorf("unable to write SSH key: %s", err.Error())
+	}
+
+	command := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=yes", quote(identity))
+
+	knownHosts, err := entry(binding, KnownHosts)
+	if err != nil {
+		return "", err
+	} else if knownHosts != "" {
+		command += fmt.Sprintf(" -o UserKnownHostsFile=%s", quote(knownHosts))
+	} else {
+		logger.Info("%s binding has no %s, git dependencies may only be cloned from hosts the stack knows", BindingType, KnownHosts)
+	}
+
+	logger.Info("Cloning git dependencies with the SSH key from %s", binding)
+	return command, nil
+}
+
+// findBinding returns the first binding of BindingType, identified by its type file or, in the older CNB layout, its
+// metadata/kind file
+func findBinding(roots []string) (string, error) {
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+
+		bindings, err := ioutil.ReadDir(root)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		for _, b := range bindings {
+			dir := filepath.Join(root, b.Name())
+
+			for _, typeFile := range []string{"type", filepath.Join("metadata", "kind")} {
+				buf, err := ioutil.ReadFile(filepath.Join(dir, typeFile))
+				if err == nil && strings.TrimSpace(string(buf)) == BindingType {
+					return dir, nil
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// entry returns the path of a binding entry, which the older CNB layout keeps in a secret directory
+func entry(binding, name string) (string, error) {
+	for _, path := range []string{filepath.Join(binding, name), filepath.Join(binding, "secret", name)} {
+		if exists, err := helper.FileExists(path); err != nil {
+			return "", err
+		} else if exists {
+			return path, nil
+		}
+	}
+
+	return "", nil
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,157 @@
+package git_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/libcfbuildpack/logger"
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/git"
+	"github.com/cloudfoundry/npm-cnb/utils"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitGit(t *testing.T) {
+	spec.Run(t, "Git", testGit, spec.Report(report.Terminal{}))
+}
+
+func testGit(t *testing.T, when spec.G, it spec.S) {
+	var root string
+
+	it.Before(func() {
+		RegisterTestingT(t)
+
+		var err error
+		root, err = ioutil.TempDir("", "git")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	it.After(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	when("mirroring a repository", func() {
+		var (
+			client git.Git
+			source string
+			mirror string
+		)
+
+		commit := func() string {
+			cmd := exec.Command("sh", "-c", "git -c user.name=test -c user.email=test@example.com commit -q --allow-empty -m commit && git rev-parse HEAD")
+			cmd.Dir = source
+			output, err := cmd.Output()
+			Expect(err).NotTo(HaveOccurred())
+			return strings.TrimSpace(string(output))
+		}
+
+		it.Before(func() {
+			if _, err := exec.LookPath("git"); err != nil {
+				t.Skip("git is not available")
+			}
+
+			source = filepath.Join(root, "source")
+			mirror = filepath.Join(root, "cache", "source.git")
+			Expect(os.MkdirAll(source, 0777)).To(Succeed())
+			Expect(exec.Command("git", "init", "-q", source).Run()).To(Succeed())
+
+			client = git.Git{Runner: utils.CommandRunner{}, Logger: logger.Logger{}}
+		})
+
+		it("clones the repository, and only fetches again for a commit it does not have", func() {
+			first := commit()
+
+			fetched, err := client.Mirror("file://"+source, mirror, first)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fetched).To(BeTrue())
+
+			fetched, err = client.Mirror("file://"+source, mirror, first)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fetched).To(BeFalse())
+
+			fetched, err = client.Mirror("file://"+source, mirror, commit())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fetched).To(BeTrue())
+		})
+
+		it("fetches from the URL it is given rather than the one it cloned from", func() {
+			first := commit()
+
+			_, err := client.Mirror("file://"+source, mirror, first)
+			Expect(err).NotTo(HaveOccurred())
+
+			moved := filepath.Join(root, "moved")
+			Expect(os.Rename(source, moved)).To(Succeed())
+			source = moved
+
+			fetched, err := client.Mirror("file://"+moved, mirror, commit())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fetched).To(BeTrue())
+		})
+
+		it("fails when the repository does not have the commit", func() {
+			commit()
+
+			_, err := client.Mirror("file://"+source, mirror, "0123456789abcdef0123456789abcdef01234567")
+			Expect(err).To(MatchError("commit 0123456789abcdef0123456789abcdef01234567 not found"))
+		})
+
+		it("does not treat a URL starting with a dash as an option", func() {
+			first := commit()
+
+			// Clones run in the directory of the mirror, against which a relative URL resolves
+			Expect(os.MkdirAll(filepath.Dir(mirror), 0777)).To(Succeed())
+			Expect(os.Rename(source, filepath.Join(filepath.Dir(mirror), "-source"))).To(Succeed())
+
+			_, err := client.Mirror("-source", mirror, first)
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	when("configuring SSH", func() {
+		var bindings, dir string
+
+		it.Before(func() {
+			bindings = filepath.Join(root, "bindings")
+			dir = filepath.Join(root, "ssh")
+			Expect(os.MkdirAll(dir, 0777)).To(Succeed())
+		})
+
+		it("uses the key and known hosts from the binding", func() {
+			test.WriteFile(t, filepath.Join(bindings, "other", "type"), "mysql")
+			test.WriteFile(t, filepath.Join(bindings, "deploy-key", "type"), git.BindingType)
+			test.WriteFile(t, filepath.Join(bindings, "deploy-key", git.PrivateKey), "some-key")
+			test.WriteFile(t, filepath.Join(bindings, "deploy-key", git.KnownHosts), "github.com ssh-ed25519 AAAA")
+
+			command, err := git.ConfigureSSH([]string{filepath.Join(root, "missing"), bindings}, dir, logger.Logger{})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(command).To(Equal(
+				"ssh -i '" + filepath.Join(dir, "id_git") + "' -o IdentitiesOnly=yes -o StrictHostKeyChecking=yes" +
+					" -o UserKnownHostsFile='" + filepath.Join(bindings, "deploy-key", git.KnownHosts) + "'"))
+
+			info, err := os.Stat(filepath.Join(dir, "id_git"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		it("does nothing without a binding", func() {
+			command, err := git.ConfigureSSH([]string{bindings}, dir, logger.Logger{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(command).To(BeEmpty())
+		})
+
+		it("fails when the binding has no key", func() {
+			test.WriteFile(t, filepath.Join(bindings, "deploy-key", "type"), git.BindingType)
+
+			_, err := git.ConfigureSSH([]string{bindings}, dir, logger.Logger{})
+			Expect(err).To(MatchError(ContainSubstring("has no ssh-privatekey")))
+		})
+	})
+}
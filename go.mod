@@ -1,11 +1,13 @@
 module github.com/cloudfoundry/npm-cnb
 
+go 1.13
+
 require (
-	github.com/buildpack/libbuildpack v1.8.0
+	github.com/BurntSushi/toml v0.3.1
+	github.com/buildpack/libbuildpack v1.24.0
 	github.com/cloudfoundry/dagger v0.0.0-20190108154828-8e5ab63c9f02
-	github.com/cloudfoundry/libcfbuildpack v1.37.0
-	github.com/cloudfoundry/nodejs-cnb v0.0.3-0.20181217224909-e1533a296e07
+	github.com/cloudfoundry/libcfbuildpack v1.85.0
 	github.com/golang/mock v1.2.0
-	github.com/onsi/gomega v1.4.3
+	github.com/onsi/gomega v1.7.0
 	github.com/sclevine/spec v1.2.0
 )
@@ -0,0 +1,2 @@
+#!/usr/bin/env node
+console.log(require('..').built ? 'built' : 'not built');
@@ -0,0 +1 @@
+require('fs').writeFileSync(require('path').join(__dirname, 'built.json'), JSON.stringify({ built: true }));
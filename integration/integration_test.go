@@ -1,10 +1,18 @@
 package integration
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudfoundry/dagger"
+	"github.com/cloudfoundry/npm-cnb/integration/registry"
 
 	"github.com/sclevine/spec"
 	"github.com/sclevine/spec/report"
@@ -12,6 +20,9 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+// nodeEngineURI is a release of the buildpack that provides node and, like this buildpack, implements Buildpack API 0.2
+const nodeEngineURI = "https://buildpacks.cloudfoundry.org/dependencies/org.cloudfoundry.node-engine/org.cloudfoundry.node-engine-0.0.95-any-stack-64a9235a.tgz"
+
 func TestIntegration(t *testing.T) {
 	spec.Run(t, "Integration", testIntegration, spec.Report(report.Terminal{}))
 }
@@ -23,10 +34,10 @@ func testIntegration(t *testing.T, when spec.G, it spec.S) {
 
 	when("when the node_modules are vendored", func() {
 		it("should build a working OCI image for a simple app", func() {
-			bp, err := dagger.PackageBuildpack()
+			bp, err := packageBuildpack()
 			Expect(err).ToNot(HaveOccurred())
 
-			nodeBP, err := dagger.GetRemoteBuildpack("https://github.com/cloudfoundry/nodejs-cnb/releases/download/v0.0.2/nodejs-cnb.tgz")
+			nodeBP, err := dagger.GetRemoteBuildpack(nodeEngineURI)
 			Expect(err).ToNot(HaveOccurred())
 
 			app, err := dagger.PackBuild(filepath.Join("fixtures", "simple_app_vendored"), nodeBP, bp)
@@ -41,10 +52,10 @@ func testIntegration(t *testing.T, when spec.G, it spec.S) {
 
 	when("when the node_modules are not vendored", func() {
 		it("should build a working OCI image for a simple app", func() {
-			bp, err := dagger.PackageBuildpack()
+			bp, err := packageBuildpack()
 			Expect(err).ToNot(HaveOccurred())
 
-			nodeBP, err := dagger.GetRemoteBuildpack("https://github.com/cloudfoundry/nodejs-cnb/releases/download/v0.0.2/nodejs-cnb.tgz")
+			nodeBP, err := dagger.GetRemoteBuildpack(nodeEngineURI)
 			Expect(err).ToNot(HaveOccurred())
 
 			app, err := dagger.PackBuild(filepath.Join("fixtures", "simple_app"), nodeBP, bp)
@@ -59,14 +70,96 @@ func testIntegration(t *testing.T, when spec.G, it spec.S) {
 
 	when("when there are no node modules", func() {
 		it("should build a working OCI image for an app without dependencies", func() {
-			bp, err := dagger.PackageBuildpack()
+			bp, err := packageBuildpack()
 			Expect(err).ToNot(HaveOccurred())
 
-			nodeBP, err := dagger.GetRemoteBuildpack("https://github.com/cloudfoundry/nodejs-cnb/releases/download/v0.0.2/nodejs-cnb.tgz")
+			nodeBP, err := dagger.GetRemoteBuildpack(nodeEngineURI)
 			Expect(err).ToNot(HaveOccurred())
 
 			_, err = dagger.PackBuild(filepath.Join("fixtures", "no_node_modules"), nodeBP, bp)
 			Expect(err).ToNot(HaveOccurred())
 		})
 	})
+
+	when("when BP_NPM_REGISTRY is set", func() {
+		it("should install node_modules from that registry", func() {
+			host, err := dockerHost()
+			Expect(err).ToNot(HaveOccurred())
+
+			server := registry.NewServer(filepath.Join("fixtures", "registry"), registry.WithAddress("0.0.0.0:0", host))
+			defer server.Close()
+
+			app, err := ioutil.TempDir("", "registry-app")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(app)
+
+			Expect(ioutil.WriteFile(filepath.Join(app, "package.json"),
+				[]byte(`{"name": "registry_app", "version": "0.0.0", "dependencies": {"leftpad": "0.0.1"}}`), 0644)).To(Succeed())
+			Expect(server.Lockfile(app, "leftpad@0.0.1")).To(Succeed())
+
+			bp, err := packageBuildpack()
+			Expect(err).ToNot(HaveOccurred())
+
+			nodeBP, err := dagger.GetRemoteBuildpack(nodeEngineURI)
+			Expect(err).ToNot(HaveOccurred())
+
+			image, err := packBuild(app, []string{"BP_NPM_REGISTRY=" + server.URL}, nodeBP, bp)
+			Expect(err).ToNot(HaveOccurred())
+			defer exec.Command("docker", "rmi", "-f", image).Run()
+
+			Expect(server.Requests()).To(ContainElement("/leftpad/-/leftpad-0.0.1.tgz"))
+		})
+	})
+}
+
+// packageBuildpack packages the buildpack for the host architecture into a directory, as dagger.PackageBuildpack did
+// before package.sh wrote archives by default
+func packageBuildpack() (string, error) {
+	cmd := exec.Command("../scripts/package.sh", "linux", "-dir")
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	match := regexp.MustCompile("Buildpack packaged into: (.*)").FindStringSubmatch(string(out))
+	if match == nil {
+		return "", fmt.Errorf("unable to find the packaged buildpack in:\n%s", out)
+	}
+
+	return match[1], nil
+}
+
+// packBuild builds an image, like dagger.PackBuild, with variables set in the build environment, and returns its name
+func packBuild(appDir string, env []string, buildpacks ...string) (string, error) {
+	image := fmt.Sprintf("npm-cnb-integration-%d", time.Now().UnixNano())
+
+	cmd := exec.Command("pack", "build", image, "--no-pull")
+	for _, e := range env {
+		cmd.Args = append(cmd.Args, "--env", e)
+	}
+	for _, bp := range buildpacks {
+		cmd.Args = append(cmd.Args, "--buildpack", bp)
+	}
+	cmd.Dir = appDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return image, cmd.Run()
+}
+
+// dockerHost returns the address the build container reaches the host on: the gateway of docker's bridge network,
+// or host.docker.internal where docker runs in a VM
+func dockerHost() (string, error) {
+	out, err := exec.Command("docker", "network", "inspect", "bridge", "--format", "{{(index .IPAM.Config 0).Gateway}}").Output()
+	if err != nil {
+		return "", err
+	}
+
+	if host := strings.TrimSpace(string(out)); host != "" {
+		return host, nil
+	}
+
+	return "host.docker.internal", nil
 }
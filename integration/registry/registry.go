@@ -0,0 +1,317 @@
+// Package registry serves an npm registry from fixture directories so that builds can be tested without the network.
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server serves packuments and tarballs for the packages under Root, laid out as <name>/<version>/, e.g.
+// leftpad/0.0.1/package.json or @cnb/scripted/1.0.0/package.json.
+type Server struct {
+	Root string
+	URL  string
+
+	server   *httptest.Server
+	listen   string
+	host     string
+	token    string
+	mutex    sync.Mutex
+	failures int
+	requests []string
+}
+
+type Option func(*Server)
+
+// WithToken requires requests to send the token as a bearer token, as npm does for an _authToken
+func WithToken(token string) Option {
+	return func(s *Server) { s.token = token }
+}
+
+// WithAddress listens on address, e.g. "0.0.0.0:0", and serves URLs on host, so that a build in a container can reach
+// the server through the host's address on the container network rather than the loopback address httptest uses
+func WithAddress(address, host string) Option {
+	return func(s *Server) { s.listen, s.host = address, host }
+}
+
+// WithFailures makes the first n requests fail with 503 Service Unavailable
+func WithFailures(n int) Option {
+	return func(s *Server) { s.failures = n }
+}
+
+func NewServer(root string, options ...Option) *Server {
+	s := &Server{Root: root}
+	for _, option := range options {
+		option(s)
+	}
+
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	if s.listen != "" {
+		listener, err := net.Listen("tcp", s.listen)
+		if err != nil {
+			panic(fmt.Sprintf("registry: failed to listen on %s: %v", s.listen, err))
+		}
+
+		_ = s.server.Listener.Close()
+		s.server.Listener = listener
+	}
+	s.server.Start()
+
+	s.URL = s.server.URL
+	if s.host != "" {
+		_, port, _ := net.SplitHostPort(s.server.Listener.Addr().String())
+		s.URL = "http://" + net.JoinHostPort(s.host, port)
+	}
+
+	return s
+}
+
+// Close stops the server, after which the registry behaves as if the build were offline
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Requests returns the paths requested so far
+func (s *Server) Requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+// Tarball returns the URL a lockfile would record as resolved for the package
+func (s *Server) Tarball(name, version string) string {
+	return fmt.Sprintf("%s/%s/-/%s-%s.tgz", s.URL, name, path.Base(name), version)
+}
+
+// Integrity returns the sha512 subresource integrity of the package tarball
+func (s *Server) Integrity(name, version string) (string, error) {
+	buf, err := s.tarball(name, version)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha512.Sum512(buf)
+	return "sha512-" + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// Lockfile writes a v1 package-lock.json into dir that resolves the given name@version packages from this server
+func (s *Server) Lockfile(dir string, packages ...string) error {
+	dependencies := map[string]interface{}{}
+
+	for _, p := range packages {
+		i := strings.LastIndex(p, "@")
+		if i <= 0 {
+			return fmt.Errorf("expected name@version, got %q", p)
+		}
+		name, version := p[:i], p[i+1:]
+
+		integrity, err := s.Integrity(name, version)
+		if err != nil {
+			return err
+		}
+
+		dependencies[name] = map[string]string{
+			"version":   version,
+			"resolved":  s.Tarball(name, version),
+			"integrity": integrity,
+		}
+	}
+
+	buf, err := json.MarshalIndent(map[string]interface{}{
+		"lockfileVersion": 1,
+		"requires":        true,
+		"dependencies":    dependencies,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, "package-lock.json"), buf, 0644)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, r.URL.Path)
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mutex.Unlock()
+
+	if fail {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	p, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if i := strings.Index(p, "/-/"); i >= 0 {
+		s.serveTarball(w, p[:i], p[i+3:])
+		return
+	}
+
+	s.servePackument(w, p)
+}
+
+func (s *Server) servePackument(w http.ResponseWriter, name string) {
+	versions, err := ioutil.ReadDir(filepath.Join(s.Root, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		http.Error(w, `{"error":"Not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	packument := map[string]interface{}{"name": name}
+	manifests := map[string]interface{}{}
+	var latest []string
+
+	for _, v := range versions {
+		manifest, err := s.manifest(name, v.Name())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		manifests[v.Name()] = manifest
+		latest = append(latest, v.Name())
+	}
+
+	sort.Strings(latest)
+	packument["versions"] = manifests
+	packument["dist-tags"] = map[string]string{"latest": latest[len(latest)-1]}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(packument)
+}
+
+func (s *Server) serveTarball(w http.ResponseWriter, name, file string) {
+	version := strings.TrimSuffix(strings.TrimPrefix(file, path.Base(name)+"-"), ".tgz")
+
+	buf, err := s.tarball(name, version)
+	if os.IsNotExist(err) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(buf)
+}
+
+func (s *Server) manifest(name, version string) (map[string]interface{}, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(s.Root, filepath.FromSlash(name), version, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := map[string]interface{}{}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return nil, err
+	}
+
+	tarball, err := s.tarball(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	sha := sha1.Sum(tarball)
+	integrity, err := s.Integrity(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest["dist"] = map[string]string{
+		"tarball":   s.Tarball(name, version),
+		"shasum":    hex.EncodeToString(sha[:]),
+		"integrity": integrity,
+	}
+
+	return manifest, nil
+}
+
+// tarball packs a fixture the way `npm pack` does, under a package/ prefix, with fixed timestamps so its
+// integrity is stable
+func (s *Server) tarball(name, version string) ([]byte, error) {
+	root := filepath.Join(s.Root, filepath.FromSlash(name), version)
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    path.Join("package", filepath.ToSlash(rel)),
+			Mode:    int64(info.Mode().Perm()),
+			Size:    int64(len(content)),
+			ModTime: time.Unix(499162500, 0),
+		}); err != nil {
+			return err
+		}
+
+		_, err = tw.Write(content)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,150 @@
+package registry_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/npm-cnb/integration/registry"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitRegistry(t *testing.T) {
+	spec.Run(t, "Registry", testRegistry, spec.Report(report.Terminal{}))
+}
+
+func testRegistry(t *testing.T, when spec.G, it spec.S) {
+	var (
+		server *registry.Server
+		root   = filepath.Join("..", "fixtures", "registry")
+		get    func(path string, headers ...string) (*http.Response, []byte)
+	)
+
+	it.Before(func() {
+		RegisterTestingT(t)
+
+		get = func(path string, headers ...string) (*http.Response, []byte) {
+			req, err := http.NewRequest("GET", server.URL+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			for i := 0; i+1 < len(headers); i += 2 {
+				req.Header.Set(headers[i], headers[i+1])
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+
+			return resp, body
+		}
+	})
+
+	it.After(func() {
+		server.Close()
+	})
+
+	when("listening on another address", func() {
+		it("serves URLs on the given host", func() {
+			server = registry.NewServer(root, registry.WithAddress("0.0.0.0:0", "localhost"))
+			Expect(server.URL).To(MatchRegexp(`^http://localhost:\d+$`))
+
+			resp, body := get("/leftpad")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(ContainSubstring(server.URL + "/leftpad/-/leftpad-0.0.1.tgz"))
+		})
+	})
+
+	when("serving fixtures", func() {
+		it.Before(func() {
+			server = registry.NewServer(root)
+		})
+
+		it("serves packuments with tarball URLs on the server", func() {
+			resp, body := get("/leftpad")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			var packument struct {
+				DistTags map[string]string `json:"dist-tags"`
+				Versions map[string]struct {
+					Dist struct {
+						Tarball   string `json:"tarball"`
+						Integrity string `json:"integrity"`
+					} `json:"dist"`
+				} `json:"versions"`
+			}
+			Expect(json.Unmarshal(body, &packument)).To(Succeed())
+
+			Expect(packument.DistTags["latest"]).To(Equal("0.0.1"))
+			Expect(packument.Versions["0.0.1"].Dist.Tarball).To(Equal(server.Tarball("leftpad", "0.0.1")))
+			Expect(packument.Versions["0.0.1"].Dist.Integrity).To(HavePrefix("sha512-"))
+		})
+
+		it("serves scoped packuments", func() {
+			resp, _ := get("/@cnb%2fscripted")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		it("serves reproducible tarballs", func() {
+			resp, first := get("/leftpad/-/leftpad-0.0.1.tgz")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			_, second := get("/leftpad/-/leftpad-0.0.1.tgz")
+			Expect(first).To(Equal(second))
+		})
+
+		it("returns 404 for unknown packages", func() {
+			resp, _ := get("/missing")
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+
+		it("writes lockfiles that resolve from the server", func() {
+			dir, err := ioutil.TempDir("", "registry")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			Expect(server.Lockfile(dir, "leftpad@0.0.1", "@cnb/scripted@1.0.0")).To(Succeed())
+
+			buf, err := ioutil.ReadFile(filepath.Join(dir, "package-lock.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf)).To(ContainSubstring(server.Tarball("@cnb/scripted", "1.0.0")))
+		})
+	})
+
+	when("authentication is required", func() {
+		it.Before(func() {
+			server = registry.NewServer(root, registry.WithToken("secret"))
+		})
+
+		it("rejects requests without the token", func() {
+			resp, _ := get("/leftpad")
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+			resp, _ = get("/leftpad", "Authorization", "Bearer secret")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	when("the registry is flaky", func() {
+		it.Before(func() {
+			server = registry.NewServer(root, registry.WithFailures(1))
+		})
+
+		it("fails the first requests", func() {
+			resp, _ := get("/leftpad")
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+			resp, _ = get("/leftpad")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(server.Requests()).To(Equal([]string{"/leftpad", "/leftpad"}))
+		})
+	})
+}
@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/libcfbuildpack/layers"
+)
+
+const (
+	Dependency = "build-report"
+	ReportFile = "report.json"
+)
+
+type Logger interface {
+	Info(format string, args ...interface{})
+}
+
+// Step is a timed part of the build, optionally with the size of the directory it produced
+type Step struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration_ns"`
+	Files    int64         `json:"files,omitempty"`
+	Bytes    int64         `json:"bytes,omitempty"`
+}
+
+// Recorder collects build steps. A nil Recorder runs steps without recording them.
+type Recorder struct {
+	mutex sync.Mutex
+	steps []Step
+	now   func() time.Time
+}
+
+type Metadata struct {
+	Name string
+	Hash string
+}
+
+func (m Metadata) Identity() (name string, version string) {
+	return m.Name, m.Hash
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{now: time.Now}
+}
+
+// Time runs f and records how long it took
+func (r *Recorder) Time(name string, f func() error) error {
+	return r.TimeDir(name, "", f)
+}
+
+// TimeDir runs f and records how long it took along with the number of files and bytes in dir afterwards
+func (r *Recorder) TimeDir(name, dir string, f func() error) error {
+	if r == nil {
+		return f()
+	}
+
+	start := r.now()
+	err := f()
+	step := Step{Name: name, Duration: r.now().Sub(start)}
+
+	if dir != "" {
+		step.Files, step.Bytes = measure(dir)
+	}
+
+	r.mutex.Lock()
+	r.steps = append(r.steps, step)
+	r.mutex.Unlock()
+
+	return err
+}
+
+func (r *Recorder) Steps() []Step {
+	if r == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]Step(nil), r.steps...)
+}
+
+// Summary renders the recorded steps as a table for the build log
+func (r *Recorder) Summary() string {
+	steps := r.Steps()
+
+	width := len("Step")
+	for _, s := range steps {
+		if len(s.Name) > width {
+			width = len(s.Name)
+		}
+	}
+
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "%-*s  %10s  %8s  %12s\n", width, "Step", "Duration", "Files", "Bytes")
+	for _, s := range steps {
+		_, _ = fmt.Fprintf(&b, "%-*s  %10s  %8s  %12s\n", width, s.Name, s.Duration.Round(time.Millisecond), count(s.Files), count(s.Bytes))
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Report logs the summary and writes the JSON report into a build-only layer
+func (r *Recorder) Report(layer layers.Layer, logger Logger) error {
+	steps := r.Steps()
+	if len(steps) == 0 {
+		return nil
+	}
+
+	for _, line := range strings.Split(r.Summary(), "\n") {
+		logger.Info(line)
+	}
+
+	buf, err := json.MarshalIndent(struct {
+		Steps []Step `json:"steps"`
+	}{steps}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(buf)
+	return layer.Contribute(Metadata{Dependency, hex.EncodeToString(hash[:])}, func(layer layers.Layer) error {
+		if err := os.MkdirAll(layer.Root, 0777); err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(filepath.Join(layer.Root, ReportFile), buf, 0644)
+	}, layers.Build)
+}
+
+func count(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%d", n)
+}
+
+func measure(dir string) (int64, int64) {
+	var files, bytes int64
+
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			files++
+			bytes += info.Size()
+		}
+
+		return nil
+	})
+
+	return files, bytes
+}
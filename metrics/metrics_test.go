@@ -0,0 +1,88 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/metrics"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitMetrics(t *testing.T) {
+	spec.Run(t, "Metrics", testMetrics, spec.Report(report.Terminal{}))
+}
+
+func testMetrics(t *testing.T, when spec.G, it spec.S) {
+	var recorder *metrics.Recorder
+
+	it.Before(func() {
+		RegisterTestingT(t)
+		recorder = metrics.NewRecorder()
+	})
+
+	when("timing steps", func() {
+		it("records each step and returns its error", func() {
+			Expect(recorder.Time("first", func() error { return nil })).To(Succeed())
+			Expect(recorder.Time("second", func() error { return errors.New("failed") })).To(MatchError("failed"))
+
+			steps := recorder.Steps()
+			Expect(steps).To(HaveLen(2))
+			Expect(steps[0].Name).To(Equal("first"))
+			Expect(steps[1].Name).To(Equal("second"))
+		})
+
+		it("measures the directory a step produced", func() {
+			dir, err := ioutil.TempDir("", "metrics")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(recorder.TimeDir("write", dir, func() error {
+				test.WriteFile(t, filepath.Join(dir, "a"), "12345")
+				test.WriteFile(t, filepath.Join(dir, "nested", "b"), "123")
+				return nil
+			})).To(Succeed())
+
+			steps := recorder.Steps()
+			Expect(steps[0].Files).To(Equal(int64(2)))
+			Expect(steps[0].Bytes).To(Equal(int64(8)))
+		})
+
+		it("runs steps without a recorder", func() {
+			var nilRecorder *metrics.Recorder
+
+			ran := false
+			Expect(nilRecorder.Time("step", func() error { ran = true; return nil })).To(Succeed())
+			Expect(ran).To(BeTrue())
+			Expect(nilRecorder.Steps()).To(BeEmpty())
+		})
+	})
+
+	when("reporting", func() {
+		it("summarizes steps and writes a build-only report layer", func() {
+			Expect(recorder.Time("npm install", func() error { return nil })).To(Succeed())
+
+			Expect(recorder.Summary()).To(ContainSubstring("npm install"))
+
+			factory := test.NewBuildFactory(t)
+			layer := factory.Build.Layers.Layer(metrics.Dependency)
+			Expect(recorder.Report(layer, factory.Build.Logger)).To(Succeed())
+
+			Expect(layer).To(test.HaveLayerMetadata(true, false, false))
+
+			buf, err := ioutil.ReadFile(filepath.Join(layer.Root, metrics.ReportFile))
+			Expect(err).NotTo(HaveOccurred())
+
+			var report struct {
+				Steps []metrics.Step `json:"steps"`
+			}
+			Expect(json.Unmarshal(buf, &report)).To(Succeed())
+			Expect(report.Steps).To(HaveLen(1))
+			Expect(report.Steps[0].Name).To(Equal("npm install"))
+		})
+	})
+}
@@ -0,0 +1,218 @@
+package modules
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+	"github.com/cloudfoundry/libcfbuildpack/layers"
+)
+
+const (
+	GitCache = "git-cache"
+
+	// GitCacheVersion identifies the git cache layer; bump it to discard every cached clone
+	GitCacheVersion = "1"
+
+	// gitConfig is the git config file in the git cache layer, found by git through XDG_CONFIG_HOME
+	gitConfig = "git/config"
+)
+
+// gitHosts are the hosts of the shorthand git sources npm accepts, e.g. github:org/repo
+var gitHosts = map[string]string{"github": "github.com", "gitlab": "gitlab.com", "bitbucket": "bitbucket.org"}
+
+// GitDependency is a package installed from a git repository
+type GitDependency struct {
+	Name   string
+	URL    string
+	Commit string
+}
+
+// mirror is the directory in the git cache layer that holds the clone of the repository
+func (g GitDependency) mirror() string {
+	hash := sha256.Sum256([]byte(g.URL))
+	return hex.EncodeToString(hash[:8]) + ".git"
+}
+
+// urls returns the URLs npm may clone the repository from. npm tries hosted repositories over both HTTPS and SSH.
+func (g GitDependency) urls() []string {
+	for _, host := range gitHosts {
+		for _, prefix := range []string{"ssh://git@" + host + "/", "https://" + host + "/"} {
+			if strings.HasPrefix(g.URL, prefix) {
+				path := strings.TrimPrefix(g.URL, prefix)
+				return []string{"ssh://git@" + host + "/" + path, "https://" + host + "/" + path, "git@" + host + ":" + path}
+			}
+		}
+	}
+
+	return []string{g.URL}
+}
+
+// sources returns the URLs to clone the repository from, in the order to try them. A repository on a known host is
+// cloned over SSH first when there is an SSH key to clone with, and over HTTPS first otherwise.
+func (g GitDependency) sources(ssh bool) []string {
+	for _, host := range gitHosts {
+		for _, prefix := range []string{"ssh://git@" + host + "/", "https://" + host + "/"} {
+			if strings.HasPrefix(g.URL, prefix) {
+				path := strings.TrimPrefix(g.URL, prefix)
+				if ssh {
+					return []string{"ssh://git@" + host + "/" + path, "https://" + host + "/" + path}
+				}
+				return []string{"https://" + host + "/" + path, "ssh://git@" + host + "/" + path}
+			}
+		}
+	}
+
+	return []string{g.URL}
+}
+
+// GitEnv returns the variables that make git, run by npm, read the config written to the git cache layer, which
+// points it at the cached clones. git 2.17 on the stacks does not support GIT_CONFIG_COUNT, but reads
+// $XDG_CONFIG_HOME/git/config in addition to the user's config.
+func GitEnv(layer layers.Layer) []string {
+	return []string{"XDG_CONFIG_HOME=" + layer.Root}
+}
+
+// ParseGitSource returns the clone URL and commit of a package-lock.json "resolved", or a v1 "version", that points at
+// a git repository, e.g. git+ssh://git@github.com/org/repo.git#<commit> or github:org/repo#<commit>
+func ParseGitSource(source string) (url string, commit string, ok bool) {
+	if i := strings.Index(source, "#"); i >= 0 {
+		source, commit = source[:i], source[i+1:]
+	}
+
+	switch {
+	case strings.HasPrefix(source, "git+"):
+		return strings.TrimPrefix(source, "git+"), commit, true
+	case strings.HasPrefix(source, "git://"):
+		return source, commit, true
+	}
+
+	if i := strings.Index(source, ":"); i > 0 {
+		if host, ok := gitHosts[source[:i]]; ok {
+			return fmt.Sprintf("ssh://git@%s/%s.git", host, strings.TrimSuffix(source[i+1:], ".git")), commit, true
+		}
+	}
+
+	return "", "", false
+}
+
+// FindGitDependencies returns the packages in a lockfile that are installed from git repositories
+func FindGitDependencies(packages []LockfilePackage) []GitDependency {
+	var dependencies []GitDependency
+	seen := map[string]bool{}
+
+	for _, p := range packages {
+		source := p.Resolved
+		if source == "" {
+			source = p.Version
+		}
+
+		url, commit, ok := ParseGitSource(source)
+		if !ok || seen[url+"#"+commit] {
+			continue
+		}
+
+		seen[url+"#"+commit] = true
+		dependencies = append(dependencies, GitDependency{Name: p.Name, URL: url, Commit: commit})
+	}
+
+	sort.Slice(dependencies, func(i, j int) bool { return dependencies[i].Name < dependencies[j].Name })
+	return dependencies
+}
+
+func gitNames(dependencies []GitDependency) string {
+	var names []string
+	for _, d := range dependencies {
+		names = append(names, d.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (c Contributor) contributeGitCache(layer layers.Layer) error {
+	if err := os.RemoveAll(layer.Root); err != nil {
+		return fmt.Errorf("unable to clear git cache layer: %s", err.Error())
+	}
+
+	if err := os.MkdirAll(layer.Root, 0777); err != nil {
+		return fmt.Errorf("unable make git cache layer: %s", err.Error())
+	}
+
+	return nil
+}
+
+// mirrorGitDependencies brings the cached clones of git dependencies up to date, removes those no longer in the
+// lockfile and writes the git config that points git at them, so that npm clones from the layer instead of the network
+func (c Contributor) mirrorGitDependencies() error {
+	layer := c.gitCacheLayer
+	mirrors := map[string]bool{}
+
+	var config bytes.Buffer
+	for _, dependency := range c.gitDependencies {
+		dir := filepath.Join(layer.Root, dependency.mirror())
+
+		fetched, err := c.mirror(dependency, dir)
+		if err != nil {
+			return err
+		}
+
+		if fetched {
+			layer.Logger.Info("Fetched %s from %s", dependency.Name, dependency.URL)
+		} else {
+			layer.Logger.Info("Reusing cached clone of %s at %s", dependency.Name, dependency.Commit)
+		}
+
+		if !mirrors[dependency.mirror()] {
+			mirrors[dependency.mirror()] = true
+			_, _ = fmt.Fprintf(&config, "[url %q]\n", "file://"+dir)
+			for _, url := range dependency.urls() {
+				_, _ = fmt.Fprintf(&config, "\tinsteadOf = %s\n", url)
+			}
+		}
+	}
+
+	files, err := ioutil.ReadDir(layer.Root)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".git") && !mirrors[f.Name()] {
+			if err := os.RemoveAll(filepath.Join(layer.Root, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := helper.WriteFile(filepath.Join(layer.Root, filepath.FromSlash(gitConfig)), 0644, config.String()); err != nil {
+		return fmt.Errorf("unable to write git config: %s", err.Error())
+	}
+
+	return nil
+}
+
+// mirror clones a dependency's repository from each of its sources in turn, until one succeeds
+func (c Contributor) mirror(dependency GitDependency, dir string) (bool, error) {
+	sources := dependency.sources(c.GitSSH)
+
+	for i, url := range sources {
+		fetched, err := c.Git.Mirror(url, dir, dependency.Commit)
+		if err == nil {
+			return fetched, nil
+		}
+
+		if i == len(sources)-1 {
+			return false, fmt.Errorf("unable to clone %s from %s: %s", dependency.Name, url, err.Error())
+		}
+
+		c.gitCacheLayer.Logger.Info("Unable to clone %s from %s, trying %s", dependency.Name, url, sources[i+1])
+	}
+
+	return false, nil
+}
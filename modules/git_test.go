@@ -0,0 +1,76 @@
+package modules_test
+
+import (
+	"testing"
+
+	"github.com/cloudfoundry/npm-cnb/modules"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitGit(t *testing.T) {
+	spec.Run(t, "Git", testGit, spec.Report(report.Terminal{}))
+}
+
+func testGit(t *testing.T, when spec.G, it spec.S) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+
+	it.Before(func() {
+		RegisterTestingT(t)
+	})
+
+	when("modules.ParseGitSource", func() {
+		it("parses git URLs", func() {
+			for source, expected := range map[string]string{
+				"git+ssh://git@github.com/org/repo.git#" + commit: "ssh://git@github.com/org/repo.git",
+				"git+https://gitlab.com/org/repo.git#" + commit:   "https://gitlab.com/org/repo.git",
+				"git://example.com/repo.git#" + commit:            "git://example.com/repo.git",
+				"github:org/repo#" + commit:                       "ssh://git@github.com/org/repo.git",
+			} {
+				url, c, ok := modules.ParseGitSource(source)
+				Expect(ok).To(BeTrue(), source)
+				Expect(url).To(Equal(expected))
+				Expect(c).To(Equal(commit))
+			}
+		})
+
+		it("ignores registry and tarball sources", func() {
+			for _, source := range []string{"https://registry.npmjs.org/leftpad/-/leftpad-0.0.1.tgz", "1.0.0", "file:../shared"} {
+				_, _, ok := modules.ParseGitSource(source)
+				Expect(ok).To(BeFalse(), source)
+			}
+		})
+	})
+
+	when("modules.FindGitDependencies", func() {
+		it("finds git dependencies in v1 and v2 lockfiles", func() {
+			v1, err := modules.ParseLockfile([]byte(`{"lockfileVersion": 1, "dependencies": {
+				"leftpad": {"version": "0.0.1", "resolved": "https://registry.npmjs.org/leftpad/-/leftpad-0.0.1.tgz"},
+				"private": {"version": "git+ssh://git@github.com/org/private.git#` + commit + `"},
+				"remote": {"version": "https://example.com/remote-1.0.0.tgz"}
+			}}`))
+			Expect(err).NotTo(HaveOccurred())
+
+			v2, err := modules.ParseLockfile([]byte(`{"lockfileVersion": 2, "packages": {
+				"": {"name": "app"},
+				"node_modules/private": {"version": "1.0.0", "resolved": "git+ssh://git@github.com/org/private.git#` + commit + `"},
+				"node_modules/leftpad": {"version": "0.0.1", "resolved": "https://registry.npmjs.org/leftpad/-/leftpad-0.0.1.tgz"}
+			}}`))
+			Expect(err).NotTo(HaveOccurred())
+
+			expected := []modules.GitDependency{{Name: "private", URL: "ssh://git@github.com/org/private.git", Commit: commit}}
+			Expect(modules.FindGitDependencies(v1)).To(Equal(expected))
+			Expect(modules.FindGitDependencies(v2)).To(Equal(expected))
+		})
+
+		it("records the source of v1 tarball dependencies", func() {
+			packages, err := modules.ParseLockfile([]byte(`{"lockfileVersion": 1, "dependencies": {
+				"remote": {"version": "https://example.com/remote-1.0.0.tgz"}
+			}}`))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(packages[0].Resolved).To(Equal("https://example.com/remote-1.0.0.tgz"))
+		})
+	})
+}
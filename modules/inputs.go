@@ -0,0 +1,138 @@
+package modules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// InputsEnv lists the files and directories in the app, e.g. "package.json,.npmrc,patches/", that make up the
+	// identity of the node_modules layer
+	InputsEnv = "BP_NPM_INPUTS"
+
+	// Lockfile is always an input, since it determines what npm installs
+	Lockfile = "package-lock.json"
+
+	// npmrc is always an input, digested as the npm config, which leaves out credentials and includes BP_NPM_REGISTRY,
+	// rather than as a file
+	npmrc = ".npmrc"
+)
+
+// DefaultInputs are the inputs used when InputsEnv is not set. patches/ holds the patches patch-package applies after
+// an install.
+var DefaultInputs = []string{Lockfile, "package.json", "patches/"}
+
+// ParseInputs parses the comma separated value of InputsEnv
+func ParseInputs(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return DefaultInputs
+	}
+
+	inputs := []string{Lockfile}
+	for _, input := range strings.Split(value, ",") {
+		if input = strings.TrimSpace(input); input != "" && input != Lockfile {
+			inputs = append(inputs, input)
+		}
+	}
+
+	return inputs
+}
+
+// HashInputs digests each input that exists in the app. A directory's digest covers the names, modes and contents of
+// everything in it.
+func HashInputs(appRoot string, inputs []string) (map[string]string, error) {
+	digests := map[string]string{}
+
+	for _, input := range inputs {
+		path := filepath.Join(appRoot, filepath.FromSlash(input))
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		hash := sha256.New()
+		if info.IsDir() {
+			if err := hashTree(hash, path); err != nil {
+				return nil, err
+			}
+		} else {
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			_, _ = hash.Write(buf)
+		}
+
+		digests[input] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	return digests, nil
+}
+
+// DigestInputs combines the digests of the inputs into one
+func DigestInputs(inputs map[string]string) string {
+	hash := sha256.New()
+	for _, input := range sortedKeys(inputs) {
+		_, _ = fmt.Fprintf(hash, "%s=%s\n", input, inputs[input])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ChangedInputs returns the inputs that were added, removed or changed between two builds
+func ChangedInputs(previous, current map[string]string) []string {
+	var changed []string
+
+	for _, input := range sortedKeys(current) {
+		if previous[input] != current[input] {
+			changed = append(changed, input)
+		}
+	}
+
+	for _, input := range sortedKeys(previous) {
+		if _, ok := current[input]; !ok {
+			changed = append(changed, input)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// logChangedInputs reports why the node_modules layer is reinstalled, when it was contributed by an earlier build
+func (c Contributor) logChangedInputs() error {
+	var previous Metadata
+	if err := c.nodeModulesLayer.ReadMetadata(&previous); err != nil {
+		return fmt.Errorf("unable to read node_modules layer metadata: %s", err.Error())
+	}
+
+	// Layers contributed before inputs were recorded cannot say what changed
+	if previous.Inputs == nil || previous.Hash == c.NodeModulesMetadata.Hash {
+		return nil
+	}
+
+	if changed := ChangedInputs(previous.Inputs, c.NodeModulesMetadata.Inputs); len(changed) > 0 {
+		c.nodeModulesLayer.Logger.Info("Reinstalling node_modules, changed: %s", strings.Join(changed, ", "))
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
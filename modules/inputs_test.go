@@ -0,0 +1,39 @@
+package modules_test
+
+import (
+	"testing"
+
+	"github.com/cloudfoundry/npm-cnb/modules"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitInputs(t *testing.T) {
+	spec.Run(t, "Inputs", testInputs, spec.Report(report.Terminal{}))
+}
+
+func testInputs(t *testing.T, when spec.G, it spec.S) {
+	it.Before(func() {
+		RegisterTestingT(t)
+	})
+
+	when("modules.ParseInputs", func() {
+		it("defaults to the lockfile, package.json and patches", func() {
+			Expect(modules.ParseInputs("")).To(Equal([]string{"package-lock.json", "package.json", "patches/"}))
+		})
+
+		it("always includes the lockfile", func() {
+			Expect(modules.ParseInputs(" package.json, ,.nvmrc,package-lock.json")).To(Equal([]string{"package-lock.json", "package.json", ".nvmrc"}))
+		})
+	})
+
+	when("modules.ChangedInputs", func() {
+		it("returns the inputs that were added, removed or changed", func() {
+			previous := map[string]string{"package-lock.json": "a", "package.json": "b", "patches/": "c"}
+			current := map[string]string{"package-lock.json": "a", "package.json": "d", ".npmrc": "e"}
+
+			Expect(modules.ChangedInputs(previous, current)).To(Equal([]string{".npmrc", "package.json", "patches/"}))
+		})
+	})
+}
@@ -0,0 +1,159 @@
+package modules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+)
+
+// localPrefixes are the specifiers of packages installed from a path rather than a registry
+var localPrefixes = []string{"file:", "link:"}
+
+// LocalDependency is a package installed from a directory or tarball in, or next to, the app, e.g. "file:../shared"
+type LocalDependency struct {
+	Name string
+
+	// Path is where the package is installed, e.g. node_modules/shared
+	Path string
+
+	// Source is the directory or tarball the package is installed from, relative to the app root
+	Source string
+}
+
+// LocalSource returns the path a linked package in a lockfile is installed from, relative to the app root
+func LocalSource(p LockfilePackage) string {
+	source := p.Resolved
+	if source == "" {
+		source = p.Version
+	}
+
+	for _, prefix := range localPrefixes {
+		source = strings.TrimPrefix(source, prefix)
+	}
+
+	return source
+}
+
+// FindLocalDependencies returns the packages in a lockfile that are installed from a path
+func FindLocalDependencies(packages []LockfilePackage) []LocalDependency {
+	var dependencies []LocalDependency
+
+	for _, p := range packages {
+		if !p.Link || !strings.HasPrefix(p.Path, ModulesDir+"/") {
+			continue
+		}
+
+		dependencies = append(dependencies, LocalDependency{Name: p.Name, Path: p.Path, Source: LocalSource(p)})
+	}
+
+	return dependencies
+}
+
+// HashLocalDependencies digests the contents of each local dependency, other than its installed node_modules, keyed
+// by its specifier, e.g. "file:../shared", so that changing them rebuilds the node_modules layer
+func HashLocalDependencies(appRoot string, dependencies []LocalDependency) (map[string]string, error) {
+	digests := map[string]string{}
+
+	for _, d := range dependencies {
+		key := "file:" + d.Source
+		if _, ok := digests[key]; ok {
+			continue
+		}
+
+		root := filepath.Join(appRoot, filepath.FromSlash(d.Source))
+		if exists, err := helper.FileExists(root); err != nil {
+			return nil, err
+		} else if !exists {
+			return nil, fmt.Errorf(`local dependency "%s" does not exist; it must be pushed with the app`, d.Source)
+		}
+
+		hash := sha256.New()
+		if err := hashTree(hash, root); err != nil {
+			return nil, err
+		}
+
+		digests[key] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	return digests, nil
+}
+
+func hashTree(hash io.Writer, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && path != root && (info.Name() == ModulesDir || info.Name() == ".git") {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(hash, "%s -> %s\n", filepath.ToSlash(rel), target)
+		case info.IsDir():
+			_, _ = fmt.Fprintf(hash, "%s/\n", filepath.ToSlash(rel))
+		default:
+			_, _ = fmt.Fprintf(hash, "%s %o %d\n", filepath.ToSlash(rel), info.Mode().Perm(), info.Size())
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if _, err := io.Copy(hash, f); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// copyLocalDependencies replaces the links npm makes to local dependencies with copies, since links into the app, or
+// next to it, would point outside the layer
+func (c Contributor) copyLocalDependencies(nodeModulesRoot string) error {
+	for _, d := range c.localDependencies {
+		target := filepath.Join(nodeModulesRoot, filepath.FromSlash(d.Path))
+
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// npm extracts local tarballs rather than linking them
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		c.nodeModulesLayer.Logger.Info("Copying %s from %s", d.Name, d.Source)
+
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+
+		if err := helper.CopyDirectory(filepath.Join(c.app.Root, filepath.FromSlash(d.Source)), target); err != nil {
+			return fmt.Errorf("unable to copy local dependency %s: %s", d.Name, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package modules
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+)
+
+// LockfilePackage is a single installed package described by package-lock.json
+type LockfilePackage struct {
+	Path      string
+	Name      string
+	Version   string
+	Resolved  string
+	Integrity string
+	Link      bool
+}
+
+type lockfile struct {
+	LockfileVersion int                           `json:"lockfileVersion"`
+	Dependencies    map[string]lockfileDependency `json:"dependencies"`
+	Packages        map[string]lockfileEntry      `json:"packages"`
+}
+
+type lockfileDependency struct {
+	Version      string                        `json:"version"`
+	Resolved     string                        `json:"resolved"`
+	Integrity    string                        `json:"integrity"`
+	Dependencies map[string]lockfileDependency `json:"dependencies"`
+}
+
+type lockfileEntry struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Resolved  string `json:"resolved"`
+	Integrity string `json:"integrity"`
+	Link      bool   `json:"link"`
+}
+
+// ParseLockfile flattens a v1, v2 or v3 package-lock.json into the packages it installs, sorted by install path
+func ParseLockfile(buf []byte) ([]LockfilePackage, error) {
+	var l lockfile
+	if err := json.Unmarshal(buf, &l); err != nil {
+		return nil, err
+	}
+
+	var packages []LockfilePackage
+	if len(l.Packages) > 0 {
+		for p, e := range l.Packages {
+			if p == "" {
+				continue
+			}
+
+			name := e.Name
+			if name == "" {
+				name = packageName(p)
+			}
+
+			packages = append(packages, LockfilePackage{
+				Path:      p,
+				Name:      name,
+				Version:   e.Version,
+				Resolved:  e.Resolved,
+				Integrity: e.Integrity,
+				Link:      e.Link,
+			})
+		}
+	} else {
+		packages = flattenDependencies(ModulesDir, l.Dependencies)
+	}
+
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Path < packages[j].Path })
+	return packages, nil
+}
+
+func flattenDependencies(parent string, dependencies map[string]lockfileDependency) []LockfilePackage {
+	var packages []LockfilePackage
+
+	for name, d := range dependencies {
+		// v1 lockfiles record the source of git and tarball dependencies as their version
+		resolved := d.Resolved
+		if resolved == "" && strings.Contains(d.Version, ":") && !local(d.Version) {
+			resolved = d.Version
+		}
+
+		p := path.Join(parent, name)
+		packages = append(packages, LockfilePackage{
+			Path:      p,
+			Name:      name,
+			Version:   d.Version,
+			Resolved:  resolved,
+			Integrity: d.Integrity,
+			Link:      local(d.Version),
+		})
+		packages = append(packages, flattenDependencies(path.Join(p, ModulesDir), d.Dependencies)...)
+	}
+
+	return packages
+}
+
+func local(version string) bool {
+	for _, prefix := range localPrefixes {
+		if strings.HasPrefix(version, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// packageName returns the package name, including any scope, from an install path such as node_modules/@a/b
+func packageName(p string) string {
+	i := strings.LastIndex(p, ModulesDir+"/")
+	if i < 0 {
+		return p
+	}
+
+	return p[i+len(ModulesDir)+1:]
+}
@@ -56,3 +56,65 @@ func (m *MockPackageManager) Rebuild(location string) error {
 func (mr *MockPackageManagerMockRecorder) Rebuild(location interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rebuild", reflect.TypeOf((*MockPackageManager)(nil).Rebuild), location)
 }
+
+// NodeABI mocks base method
+func (m *MockPackageManager) NodeABI(location string) (string, error) {
+	ret := m.ctrl.Call(m, "NodeABI", location)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NodeABI indicates an expected call of NodeABI
+func (mr *MockPackageManagerMockRecorder) NodeABI(location interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NodeABI", reflect.TypeOf((*MockPackageManager)(nil).NodeABI), location)
+}
+
+// Config mocks base method
+func (m *MockPackageManager) Config(location string) (string, error) {
+	ret := m.ctrl.Call(m, "Config", location)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Config indicates an expected call of Config
+func (mr *MockPackageManagerMockRecorder) Config(location interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Config", reflect.TypeOf((*MockPackageManager)(nil).Config), location)
+}
+
+// MockGitClient is a mock of GitClient interface
+type MockGitClient struct {
+	ctrl     *gomock.Controller
+	recorder *MockGitClientMockRecorder
+}
+
+// MockGitClientMockRecorder is the mock recorder for MockGitClient
+type MockGitClientMockRecorder struct {
+	mock *MockGitClient
+}
+
+// NewMockGitClient creates a new mock instance
+func NewMockGitClient(ctrl *gomock.Controller) *MockGitClient {
+	mock := &MockGitClient{ctrl: ctrl}
+	mock.recorder = &MockGitClientMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockGitClient) EXPECT() *MockGitClientMockRecorder {
+	return m.recorder
+}
+
+// Mirror mocks base method
+func (m *MockGitClient) Mirror(url, dir, commit string) (bool, error) {
+	ret := m.ctrl.Call(m, "Mirror", url, dir, commit)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Mirror indicates an expected call of Mirror
+func (mr *MockGitClientMockRecorder) Mirror(url, dir, commit interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Mirror", reflect.TypeOf((*MockGitClient)(nil).Mirror), url, dir, commit)
+}
@@ -1,18 +1,19 @@
 package modules
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 
 	"github.com/cloudfoundry/libcfbuildpack/helper"
 
 	"github.com/buildpack/libbuildpack/application"
 	"github.com/cloudfoundry/libcfbuildpack/build"
 	"github.com/cloudfoundry/libcfbuildpack/layers"
+	"github.com/cloudfoundry/npm-cnb/metrics"
 )
 
 const (
@@ -20,16 +21,39 @@ const (
 	Cache      = "cache"
 	ModulesDir = "node_modules"
 	CacheDir   = "npm-cache"
+
+	// CacheVersion identifies the npm cache layer; bump it to discard every existing cache
+	CacheVersion = "1"
+
+	// PackageJSONError is the build plan metadata key detect uses to defer a "package.json" parse failure to build
+	PackageJSONError = "package_json_error"
 )
 
 type PackageManager interface {
 	Install(modulesLayer, cacheLayer, location string) error
 	Rebuild(location string) error
+	NodeABI(location string) (string, error)
+	Config(location string) (string, error)
 }
 
+// GitClient keeps mirrors of the repositories git dependencies are installed from
+type GitClient interface {
+	// Mirror clones url into dir, or fetches into an existing clone, unless it already has commit. It reports whether
+	// it had to reach the repository.
+	Mirror(url, dir, commit string) (bool, error)
+}
+
+// Metadata identifies a layer's contents. ABI and Arch are part of it because compiled native addons only run on the
+// Node.js ABI and architecture they were built for, so a layer restored from a cache shared across Node.js versions or
+// architectures is rebuilt. Inputs records the digest of each input that Hash combines, so that a rebuild can report
+// what changed.
 type Metadata struct {
-	Name string
-	Hash string
+	Name   string
+	Hash   string
+	ABI    string
+	Arch   string
+	Prune  string
+	Inputs map[string]string
 }
 
 func (m Metadata) Identity() (name string, version string) {
@@ -39,21 +63,37 @@ func (m Metadata) Identity() (name string, version string) {
 type Contributor struct {
 	NodeModulesMetadata Metadata
 	NPMCacheMetadata    Metadata
+	NativeCacheMetadata Metadata
+	GitCacheMetadata    Metadata
+	Metrics             *metrics.Recorder
+	Git                 GitClient
+	GitSSH              bool
 	buildContribution   bool
 	launchContribution  bool
 	pkgManager          PackageManager
 	app                 application.Application
 	nodeModulesLayer    layers.Layer
 	npmCacheLayer       layers.Layer
+	nativeCacheLayer    layers.Layer
+	gitCacheLayer       layers.Layer
 	launch              layers.Layers
+	lockfile            []LockfilePackage
+	gitDependencies     []GitDependency
+	localDependencies   []LocalDependency
+	cacheMaxSize        int64
+	pruneRules          PruneRules
 }
 
 func NewContributor(context build.Build, pkgManager PackageManager) (Contributor, bool, error) {
-	plan, shouldUseNPM := context.BuildPlan[Dependency]
+	plan, shouldUseNPM := MergePlans(context.Plans.Entries, Dependency)
 	if !shouldUseNPM {
 		return Contributor{}, false, nil
 	}
 
+	if parseErr, ok := plan.Metadata[PackageJSONError]; ok {
+		return Contributor{}, false, fmt.Errorf(`unable to parse "package.json": %v`, parseErr)
+	}
+
 	lockFile := filepath.Join(context.Application.Root, "package-lock.json")
 	if exists, err := helper.FileExists(lockFile); err != nil {
 		return Contributor{}, false, err
@@ -66,34 +106,142 @@ func NewContributor(context build.Build, pkgManager PackageManager) (Contributor
 		return Contributor{}, false, err
 	}
 
-	hash := sha256.Sum256(buf)
+	packages, err := ParseLockfile(buf)
+	if err != nil {
+		context.Logger.Info(`Unable to parse "package-lock.json", compiled native addons will not be reused: %s`, err.Error())
+	}
+
+	gitDependencies := FindGitDependencies(packages)
+	if len(gitDependencies) > 0 {
+		if _, err := exec.LookPath("git"); err != nil {
+			return Contributor{}, false, fmt.Errorf(`"package-lock.json" has dependencies from git repositories (%s), but git is not available on the stack; use a stack with git or publish them to a registry`,
+				gitNames(gitDependencies))
+		}
+
+		context.Logger.Info("Installing %s from git repositories", gitNames(gitDependencies))
+	}
+
+	inputs, err := HashInputs(context.Application.Root, ParseInputs(os.Getenv(InputsEnv)))
+	if err != nil {
+		return Contributor{}, false, fmt.Errorf("unable to read %s: %s", InputsEnv, err.Error())
+	}
+
+	localDependencies := FindLocalDependencies(packages)
+	localInputs, err := HashLocalDependencies(context.Application.Root, localDependencies)
+	if err != nil {
+		return Contributor{}, false, fmt.Errorf("unable to read local dependencies: %s", err.Error())
+	}
+
+	for input, digest := range localInputs {
+		inputs[input] = digest
+	}
+
+	cacheMaxSize, err := ParseSize(os.Getenv(CacheMaxSizeEnv))
+	if err != nil {
+		return Contributor{}, false, fmt.Errorf("unable to parse %s: %s", CacheMaxSizeEnv, err.Error())
+	}
+
+	pruneRules, err := LoadPruneRules(context.Application.Root)
+	if err != nil {
+		return Contributor{}, false, err
+	}
+
+	abi, err := pkgManager.NodeABI(context.Application.Root)
+	if err != nil {
+		return Contributor{}, false, fmt.Errorf("unable to determine the node ABI version: %s", err.Error())
+	}
+
+	config, err := pkgManager.Config(context.Application.Root)
+	if err != nil {
+		return Contributor{}, false, fmt.Errorf("unable to read npm config: %s", err.Error())
+	}
+
+	// The npm config, e.g. a registry, changes what npm installs whichever inputs are configured, and is digested
+	// without credentials in place of the file
+	delete(inputs, npmrc)
+	if config != "" {
+		inputs[npmrc] = config
+	}
 
 	contributor := Contributor{
 		app:                 context.Application,
 		pkgManager:          pkgManager,
 		nodeModulesLayer:    context.Layers.Layer(Dependency),
 		npmCacheLayer:       context.Layers.Layer(Cache),
+		nativeCacheLayer:    context.Layers.Layer(NativeCache),
+		gitCacheLayer:       context.Layers.Layer(GitCache),
 		launch:              context.Layers,
-		NodeModulesMetadata: Metadata{Dependency, hex.EncodeToString(hash[:])},
-		NPMCacheMetadata:    Metadata{Cache, hex.EncodeToString(hash[:])},
+		lockfile:            packages,
+		gitDependencies:     gitDependencies,
+		localDependencies:   localDependencies,
+		cacheMaxSize:        cacheMaxSize,
+		NodeModulesMetadata: Metadata{Name: Dependency, Hash: DigestInputs(inputs), ABI: abi, Arch: runtime.GOARCH, Inputs: inputs},
+		NPMCacheMetadata:    Metadata{Name: Cache, Hash: CacheVersion},
+		NativeCacheMetadata: Metadata{Name: NativeCache, Hash: abi, Arch: runtime.GOARCH},
+		GitCacheMetadata:    Metadata{Name: GitCache, Hash: GitCacheVersion},
 	}
 
-	if _, ok := plan.Metadata["build"]; ok {
-		contributor.buildContribution = true
-	}
+	contributor.buildContribution = flag(plan.Metadata, "build")
+	contributor.launchContribution = flag(plan.Metadata, "launch")
 
-	if _, ok := plan.Metadata["launch"]; ok {
-		contributor.launchContribution = true
+	// Later buildpacks may compile against the sources and type definitions pruning removes, so only a layer used
+	// solely at launch is pruned
+	if contributor.launchContribution && !contributor.buildContribution {
+		contributor.pruneRules = pruneRules
+		contributor.NodeModulesMetadata.Prune = pruneRules.Digest()
+	} else if pruneRules != nil {
+		context.Logger.Info("Not pruning node_modules, it is also used at build time")
 	}
 
 	return contributor, true, nil
 }
 
+// HasGitDependencies reports whether the lockfile installs packages from git repositories
+func (c Contributor) HasGitDependencies() bool {
+	return len(c.gitDependencies) > 0
+}
+
 func (c Contributor) Contribute() error {
-	if err := c.nodeModulesLayer.Contribute(c.NodeModulesMetadata, c.contributeNodeModules, c.flags()...); err != nil {
+	// The npm cache is contributed first so that a new cache version is discarded before npm can reuse it
+	if err := c.Metrics.Time("npm-cache layer", func() error {
+		return c.npmCacheLayer.Contribute(c.NPMCacheMetadata, c.contributeNPMCache, layers.Cache)
+	}); err != nil {
+		return err
+	}
+
+	if err := c.Metrics.Time("native-cache layer", func() error {
+		return c.nativeCacheLayer.Contribute(c.NativeCacheMetadata, c.contributeNativeCache, layers.Cache)
+	}); err != nil {
+		return err
+	}
+
+	if len(c.gitDependencies) > 0 {
+		if err := c.Metrics.Time("git-cache layer", func() error {
+			return c.gitCacheLayer.Contribute(c.GitCacheMetadata, c.contributeGitCache, layers.Cache)
+		}); err != nil {
+			return err
+		}
+
+		if err := c.Metrics.TimeDir("fetch git dependencies", c.gitCacheLayer.Root, c.mirrorGitDependencies); err != nil {
+			return err
+		}
+	}
+
+	if err := c.logChangedInputs(); err != nil {
 		return err
 	}
-	return c.npmCacheLayer.Contribute(c.NPMCacheMetadata, c.contributeNPMCache, layers.Cache)
+
+	if err := c.Metrics.TimeDir("node_modules layer", c.nodeModulesLayer.Root, func() error {
+		return c.nodeModulesLayer.Contribute(c.NodeModulesMetadata, c.contributeNodeModules, c.flags()...)
+	}); err != nil {
+		return err
+	}
+
+	if err := c.linkNodeModules(); err != nil {
+		return err
+	}
+
+	return c.Metrics.TimeDir("save npm-cache", c.npmCacheLayer.Root, c.saveNPMCache)
 }
 
 func (c Contributor) contributeNodeModules(layer layers.Layer) error {
@@ -107,12 +255,20 @@ func (c Contributor) contributeNodeModules(layer layers.Layer) error {
 	if vendored {
 		c.nodeModulesLayer.Logger.Info("Rebuilding node_modules")
 		if err := c.pkgManager.Rebuild(c.app.Root); err != nil {
-			return fmt.Errorf("unable to rebuild node_modules: %s", err.Error())
+			return toolchainError(fmt.Errorf("unable to rebuild node_modules: %s", err.Error()), nodeModules)
 		}
 	} else {
+		if err := c.discardForeignNodeModules(layer); err != nil {
+			return err
+		}
+
+		if err := c.restorePrebuilds(); err != nil {
+			return err
+		}
+
 		c.nodeModulesLayer.Logger.Info("Installing node_modules")
 		if err := c.pkgManager.Install(layer.Root, c.npmCacheLayer.Root, c.app.Root); err != nil {
-			return fmt.Errorf("unable to install node_modules: %s", err.Error())
+			return toolchainError(fmt.Errorf("unable to install node_modules: %s", err.Error()), nodeModules)
 		}
 	}
 
@@ -126,27 +282,159 @@ func (c Contributor) contributeNodeModules(layer layers.Layer) error {
 	}
 
 	if nodeModulesExist {
-		if err := helper.CopyDirectory(nodeModules, filepath.Join(layer.Root, ModulesDir)); err != nil {
+		if err := c.Metrics.Time("copy node_modules", func() error {
+			return helper.CopyDirectory(nodeModules, filepath.Join(layer.Root, ModulesDir))
+		}); err != nil {
 			return fmt.Errorf(`unable to copy "%s" to "%s": %s`, nodeModules, layer.Root, err.Error())
 		}
 
 		if err := os.RemoveAll(nodeModules); err != nil {
 			return fmt.Errorf("unable to remove node_modules from the app dir: %s", err.Error())
 		}
+
+		if err := c.copyLocalDependencies(layer.Root); err != nil {
+			return err
+		}
+
+		if err := c.prune(filepath.Join(layer.Root, ModulesDir)); err != nil {
+			return err
+		}
+
+		if err := Normalize(filepath.Join(layer.Root, ModulesDir)); err != nil {
+			return fmt.Errorf("unable to normalize node_modules: %s", err.Error())
+		}
 	}
 
-	if err := layer.OverrideSharedEnv("NODE_PATH", filepath.Join(layer.Root, ModulesDir)); err != nil {
+	addons, err := FindNativeAddons(filepath.Join(layer.Root, ModulesDir))
+	if err != nil {
+		return fmt.Errorf("unable to find native addons: %s", err.Error())
+	}
+
+	if len(addons) > 0 {
+		c.nodeModulesLayer.Logger.Info("Caching %d compiled native addon(s)", len(addons))
+		if err := c.savePrebuilds(addons); err != nil {
+			return err
+		}
+	}
+
+	if err := c.prunePrebuilds(); err != nil {
 		return err
 	}
 
-	return c.launch.WriteMetadata(layers.Metadata{Processes: []layers.Process{{"web", "npm start"}}})
+	if err := c.writeEnv(layer); err != nil {
+		return err
+	}
+
+	return c.launch.WriteApplicationMetadata(layers.Metadata{Processes: []layers.Process{{Type: "web", Command: "npm start"}}})
+}
+
+func (c Contributor) prune(nodeModules string) error {
+	if c.pruneRules == nil {
+		return nil
+	}
+
+	return c.Metrics.Time("prune node_modules", func() error {
+		removed, reclaimed, err := c.pruneRules.Prune(nodeModules)
+		if err != nil {
+			return fmt.Errorf("unable to prune node_modules: %s", err.Error())
+		}
+
+		c.nodeModulesLayer.Logger.Info("Pruned %d files and directories from node_modules, reclaimed %s", removed, FormatSize(reclaimed))
+		return nil
+	})
+}
+
+// linkNodeModules points the app's node_modules at the layer for tools that resolve packages without NODE_PATH
+func (c Contributor) linkNodeModules() error {
+	layerModules := filepath.Join(c.nodeModulesLayer.Root, ModulesDir)
+	appModules := filepath.Join(c.app.Root, ModulesDir)
+
+	if exists, err := helper.FileExists(layerModules); err != nil {
+		return fmt.Errorf("unable to stat node_modules layer: %s", err.Error())
+	} else if !exists {
+		return nil
+	}
+
+	if info, err := os.Lstat(appModules); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			c.nodeModulesLayer.Logger.Info("Leaving existing node_modules in the app dir")
+			return nil
+		}
+
+		if err := os.Remove(appModules); err != nil {
+			return fmt.Errorf("unable to remove node_modules link: %s", err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("unable to stat node_modules: %s", err.Error())
+	}
+
+	// A layer only used at build time is not in the launch image, where the link would dangle
+	if !c.launchContribution {
+		return nil
+	}
+
+	if err := os.Symlink(layerModules, appModules); err != nil {
+		return fmt.Errorf("unable to link node_modules into the app dir: %s", err.Error())
+	}
+
+	return nil
 }
 
+func (c Contributor) writeEnv(layer layers.Layer) error {
+	nodeModules := filepath.Join(layer.Root, ModulesDir)
+	bin := filepath.Join(nodeModules, ".bin")
+
+	if c.buildContribution {
+		if err := layer.OverrideBuildEnv("NODE_PATH", nodeModules); err != nil {
+			return err
+		}
+
+		if err := layer.AppendPathBuildEnv("PATH", bin); err != nil {
+			return err
+		}
+	}
+
+	if c.launchContribution {
+		if err := layer.OverrideLaunchEnv("NODE_PATH", nodeModules); err != nil {
+			return err
+		}
+
+		if err := layer.AppendPathLaunchEnv("PATH", bin); err != nil {
+			return err
+		}
+
+		if err := layer.WriteProfile(NodeEnvProfile, nodeEnvProfile); err != nil {
+			return fmt.Errorf("unable to write NODE_ENV profile: %s", err.Error())
+		}
+
+		if err := layer.WriteProfile(LinkProfile, linkProfile, c.app.Root, filepath.Join(layer.Root, ModulesDir)); err != nil {
+			return fmt.Errorf("unable to write node_modules link profile: %s", err.Error())
+		}
+
+		if err := layer.WriteProfile(MemoryProfile, "%s", memoryProfile); err != nil {
+			return fmt.Errorf("unable to write memory profile: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// contributeNPMCache starts the layer afresh, since it is only contributed when CacheVersion changed
 func (c Contributor) contributeNPMCache(layer layers.Layer) error {
+	if err := os.RemoveAll(layer.Root); err != nil {
+		return fmt.Errorf("unable to clear npm cache layer: %s", err.Error())
+	}
+
 	if err := os.MkdirAll(layer.Root, 0777); err != nil {
 		return fmt.Errorf("unable make npm cache layer: %s", err.Error())
 	}
 
+	return nil
+}
+
+// saveNPMCache moves the cache npm used back into the layer, whether or not the layer was restored this build
+func (c Contributor) saveNPMCache() error {
+	layer := c.npmCacheLayer
 	npmCache := filepath.Join(c.app.Root, CacheDir)
 
 	npmCacheExists, err := helper.FileExists(npmCache)
@@ -164,6 +452,15 @@ func (c Contributor) contributeNPMCache(layer layers.Layer) error {
 		}
 	}
 
+	reclaimed, err := PruneCache(filepath.Join(layer.Root, CacheDir), c.lockfile, c.cacheMaxSize)
+	if err != nil {
+		return fmt.Errorf("unable to prune npm-cache: %s", err.Error())
+	}
+
+	if reclaimed > 0 {
+		layer.Logger.Info("Pruned npm-cache, reclaimed %s", FormatSize(reclaimed))
+	}
+
 	return nil
 }
 
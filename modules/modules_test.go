@@ -1,14 +1,21 @@
 package modules_test
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"testing"
 
 	"github.com/cloudfoundry/libcfbuildpack/layers"
 
-	"github.com/buildpack/libbuildpack/buildplan"
+	"github.com/buildpack/libbuildpack/buildpackplan"
 	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/fakenpm"
 	"github.com/cloudfoundry/npm-cnb/modules"
+	"github.com/cloudfoundry/npm-cnb/npm"
 	"github.com/golang/mock/gomock"
 	. "github.com/onsi/gomega"
 	"github.com/sclevine/spec"
@@ -38,6 +45,9 @@ func testModules(t *testing.T, when spec.G, it spec.S) {
 			mockPkgManager = NewMockPackageManager(mockCtrl)
 
 			factory = test.NewBuildFactory(t)
+
+			mockPkgManager.EXPECT().NodeABI(factory.Build.Application.Root).Return("64", nil).AnyTimes()
+			mockPkgManager.EXPECT().Config(factory.Build.Application.Root).Return("", nil).AnyTimes()
 		})
 
 		it.After(func() {
@@ -46,20 +56,33 @@ func testModules(t *testing.T, when spec.G, it spec.S) {
 
 		when("there is no package-lock.json", func() {
 			it("fails", func() {
-				factory.AddBuildPlan(modules.Dependency, buildplan.Dependency{})
+				factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency})
 
 				_, _, err := modules.NewContributor(factory.Build, mockPkgManager)
 				Expect(err).To(HaveOccurred())
 			})
 		})
 
+		when("detect was unable to parse package.json", func() {
+			it("fails with the parse error", func() {
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"), "package lock")
+				factory.AddPlan(buildpackplan.Plan{
+					Name:     modules.Dependency,
+					Metadata: buildpackplan.Metadata{modules.PackageJSONError: "line 2, column 8: invalid character '}'"},
+				})
+
+				_, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+				Expect(err).To(MatchError(`unable to parse "package.json": line 2, column 8: invalid character '}'`))
+			})
+		})
+
 		when("there is a package-lock.json", func() {
 			it.Before(func() {
 				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"), "package lock")
 			})
 
 			it("returns true if a build plan exists with the dep", func() {
-				factory.AddBuildPlan(modules.Dependency, buildplan.Dependency{})
+				factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency})
 
 				_, willContribute, err := modules.NewContributor(factory.Build, mockPkgManager)
 				Expect(err).NotTo(HaveOccurred())
@@ -73,12 +96,55 @@ func testModules(t *testing.T, when spec.G, it spec.S) {
 			})
 
 			it("uses package-lock.json for identity", func() {
-				factory.AddBuildPlan(modules.Dependency, buildplan.Dependency{})
+				factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency})
 
 				contributor, _, _ := modules.NewContributor(factory.Build, mockPkgManager)
 				name, version := contributor.NodeModulesMetadata.Identity()
 				Expect(name).To(Equal(modules.Dependency))
-				Expect(version).To(Equal("152468741c83af08df4394d612172b58b2e7dca7164b5e6b79c5f6e96b829f77"))
+				Expect(version).To(Equal("cfe96ef6cc9a994ffc94003899d54be0d2d20b664bcd1cb929c40150df85bcf0"))
+				Expect(contributor.NodeModulesMetadata.Inputs).To(Equal(map[string]string{
+					"package-lock.json": "152468741c83af08df4394d612172b58b2e7dca7164b5e6b79c5f6e96b829f77",
+				}))
+				Expect(contributor.NodeModulesMetadata.Arch).To(Equal(runtime.GOARCH))
+				Expect(contributor.HasGitDependencies()).To(BeFalse())
+			})
+
+			it("includes the other inputs in the identity", func() {
+				factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency})
+
+				contributor, _, _ := modules.NewContributor(factory.Build, mockPkgManager)
+				_, first := contributor.NodeModulesMetadata.Identity()
+
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "patches", "leftpad+0.0.1.patch"), "some patch")
+
+				contributor, _, _ = modules.NewContributor(factory.Build, mockPkgManager)
+				_, second := contributor.NodeModulesMetadata.Identity()
+				Expect(second).NotTo(Equal(first))
+				Expect(contributor.NodeModulesMetadata.Inputs).To(HaveKey("patches/"))
+			})
+
+			it("uses the inputs in BP_NPM_INPUTS", func() {
+				factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency})
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package.json"), "{}")
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, ".nvmrc"), "12")
+
+				Expect(os.Setenv(modules.InputsEnv, ".nvmrc")).To(Succeed())
+				defer os.Unsetenv(modules.InputsEnv)
+
+				contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contributor.NodeModulesMetadata.Inputs).To(HaveLen(2))
+				Expect(contributor.NodeModulesMetadata.Inputs).To(HaveKey("package-lock.json"))
+				Expect(contributor.NodeModulesMetadata.Inputs).To(HaveKey(".nvmrc"))
+			})
+
+			it("uses a version independent of package-lock.json for the npm cache identity", func() {
+				factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency})
+
+				contributor, _, _ := modules.NewContributor(factory.Build, mockPkgManager)
+				name, version := contributor.NPMCacheMetadata.Identity()
+				Expect(name).To(Equal(modules.Cache))
+				Expect(version).To(Equal(modules.CacheVersion))
 			})
 
 			when("the app is vendored", func() {
@@ -88,8 +154,9 @@ func testModules(t *testing.T, when spec.G, it spec.S) {
 				})
 
 				it("contributes for the build phase", func() {
-					factory.AddBuildPlan(modules.Dependency, buildplan.Dependency{
-						Metadata: buildplan.Metadata{"build": true},
+					factory.AddPlan(buildpackplan.Plan{
+						Name:     modules.Dependency,
+						Metadata: buildpackplan.Metadata{"build": true},
 					})
 
 					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
@@ -100,14 +167,17 @@ func testModules(t *testing.T, when spec.G, it spec.S) {
 					layer := factory.Build.Layers.Layer(modules.Dependency)
 					Expect(layer).To(test.HaveLayerMetadata(true, true, false))
 					Expect(filepath.Join(layer.Root, modules.ModulesDir, "test_module")).To(BeARegularFile())
-					Expect(layer).To(test.HaveOverrideSharedEnvironment("NODE_PATH", filepath.Join(layer.Root, modules.ModulesDir)))
+					Expect(layer).To(test.HaveOverrideBuildEnvironment("NODE_PATH", filepath.Join(layer.Root, modules.ModulesDir)))
+					Expect(layer).To(test.HaveAppendPathBuildEnvironment("PATH", filepath.Join(layer.Root, modules.ModulesDir, ".bin")))
+					Expect(filepath.Join(layer.Root, "profile.d", modules.MemoryProfile)).NotTo(BeAnExistingFile())
 
-					Expect(filepath.Join(factory.Build.Application.Root, modules.ModulesDir)).NotTo(BeADirectory())
+					Expect(filepath.Join(factory.Build.Application.Root, modules.ModulesDir)).NotTo(BeAnExistingFile())
 				})
 
 				it("contributes for the launch phase", func() {
-					factory.AddBuildPlan(modules.Dependency, buildplan.Dependency{
-						Metadata: buildplan.Metadata{"launch": true},
+					factory.AddPlan(buildpackplan.Plan{
+						Name:     modules.Dependency,
+						Metadata: buildpackplan.Metadata{"launch": true},
 					})
 
 					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
@@ -115,14 +185,83 @@ func testModules(t *testing.T, when spec.G, it spec.S) {
 
 					Expect(contributor.Contribute()).To(Succeed())
 
-					Expect(factory.Build.Layers).To(test.HaveLaunchMetadata(layers.Metadata{Processes: []layers.Process{{"web", "npm start"}}}))
+					Expect(factory.Build.Layers).To(test.HaveApplicationMetadata(layers.Metadata{Processes: []layers.Process{{Type: "web", Command: "npm start"}}}))
 
 					layer := factory.Build.Layers.Layer(modules.Dependency)
 					Expect(layer).To(test.HaveLayerMetadata(false, true, true))
 					Expect(filepath.Join(layer.Root, modules.ModulesDir, "test_module")).To(BeARegularFile())
-					Expect(layer).To(test.HaveOverrideSharedEnvironment("NODE_PATH", filepath.Join(layer.Root, modules.ModulesDir)))
+					Expect(layer).To(test.HaveOverrideLaunchEnvironment("NODE_PATH", filepath.Join(layer.Root, modules.ModulesDir)))
+					Expect(layer).To(test.HaveAppendPathLaunchEnvironment("PATH", filepath.Join(layer.Root, modules.ModulesDir, ".bin")))
+					Expect(filepath.Join(layer.Root, "profile.d", modules.NodeEnvProfile)).To(BeARegularFile())
+					Expect(filepath.Join(layer.Root, "profile.d", modules.LinkProfile)).To(BeARegularFile())
+					Expect(filepath.Join(layer.Root, "profile.d", modules.MemoryProfile)).To(BeARegularFile())
 
-					Expect(filepath.Join(factory.Build.Application.Root, modules.ModulesDir)).NotTo(BeADirectory())
+					Expect(os.Readlink(filepath.Join(factory.Build.Application.Root, modules.ModulesDir))).To(Equal(filepath.Join(layer.Root, modules.ModulesDir)))
+				})
+
+				when("pruning is enabled", func() {
+					it.Before(func() {
+						test.WriteFile(t, filepath.Join(factory.Build.Application.Root, modules.ModulesDir, "leftpad", "CHANGELOG.md"), "changes")
+						Expect(os.Setenv(modules.PruneEnv, "true")).To(Succeed())
+					})
+
+					it.After(func() {
+						Expect(os.Unsetenv(modules.PruneEnv)).To(Succeed())
+					})
+
+					it("prunes a layer only used at launch", func() {
+						factory.AddPlan(buildpackplan.Plan{
+							Name:     modules.Dependency,
+							Metadata: buildpackplan.Metadata{"launch": true},
+						})
+
+						contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(contributor.NodeModulesMetadata.Prune).NotTo(BeEmpty())
+
+						Expect(contributor.Contribute()).To(Succeed())
+
+						layer := factory.Build.Layers.Layer(modules.Dependency)
+						Expect(filepath.Join(layer.Root, modules.ModulesDir, "leftpad", "CHANGELOG.md")).NotTo(BeAnExistingFile())
+						Expect(filepath.Join(layer.Root, modules.ModulesDir, "test_module")).To(BeARegularFile())
+					})
+
+					it("does not prune a layer used at build time", func() {
+						factory.AddPlan(buildpackplan.Plan{
+							Name:     modules.Dependency,
+							Metadata: buildpackplan.Metadata{"build": true, "launch": true},
+						})
+
+						contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(contributor.NodeModulesMetadata.Prune).To(BeEmpty())
+
+						Expect(contributor.Contribute()).To(Succeed())
+
+						layer := factory.Build.Layers.Layer(modules.Dependency)
+						Expect(filepath.Join(layer.Root, modules.ModulesDir, "leftpad", "CHANGELOG.md")).To(BeARegularFile())
+					})
+				})
+
+				it("merges the build and launch requirements of every plan entry", func() {
+					factory.AddPlan(buildpackplan.Plan{
+						Name:     modules.Dependency,
+						Metadata: buildpackplan.Metadata{"build": true},
+					})
+					factory.AddPlan(buildpackplan.Plan{
+						Name:     modules.Dependency,
+						Metadata: buildpackplan.Metadata{"launch": true, "build": false},
+					})
+
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(contributor.Contribute()).To(Succeed())
+
+					layer := factory.Build.Layers.Layer(modules.Dependency)
+					Expect(layer).To(test.HaveLayerMetadata(true, true, true))
+					Expect(layer).To(test.HaveOverrideBuildEnvironment("NODE_PATH", filepath.Join(layer.Root, modules.ModulesDir)))
+					Expect(layer).To(test.HaveOverrideLaunchEnvironment("NODE_PATH", filepath.Join(layer.Root, modules.ModulesDir)))
 				})
 			})
 
@@ -142,8 +281,9 @@ func testModules(t *testing.T, when spec.G, it spec.S) {
 				})
 
 				it("contributes for the build phase", func() {
-					factory.AddBuildPlan(modules.Dependency, buildplan.Dependency{
-						Metadata: buildplan.Metadata{"build": true},
+					factory.AddPlan(buildpackplan.Plan{
+						Name:     modules.Dependency,
+						Metadata: buildpackplan.Metadata{"build": true},
 					})
 
 					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
@@ -154,19 +294,21 @@ func testModules(t *testing.T, when spec.G, it spec.S) {
 					nodeModulesLayer := factory.Build.Layers.Layer(modules.Dependency)
 					Expect(nodeModulesLayer).To(test.HaveLayerMetadata(true, true, false))
 					Expect(filepath.Join(nodeModulesLayer.Root, modules.ModulesDir, "test_module")).To(BeARegularFile())
-					Expect(nodeModulesLayer).To(test.HaveOverrideSharedEnvironment("NODE_PATH", filepath.Join(nodeModulesLayer.Root, modules.ModulesDir)))
+					Expect(nodeModulesLayer).To(test.HaveOverrideBuildEnvironment("NODE_PATH", filepath.Join(nodeModulesLayer.Root, modules.ModulesDir)))
+					Expect(nodeModulesLayer).To(test.HaveAppendPathBuildEnvironment("PATH", filepath.Join(nodeModulesLayer.Root, modules.ModulesDir, ".bin")))
 
 					npmCacheLayer := factory.Build.Layers.Layer(modules.Cache)
 					Expect(npmCacheLayer).To(test.HaveLayerMetadata(false, true, false))
 					Expect(filepath.Join(npmCacheLayer.Root, modules.CacheDir, "test_cache_item")).To(BeARegularFile())
 
-					Expect(filepath.Join(factory.Build.Application.Root, modules.ModulesDir)).NotTo(BeADirectory())
+					Expect(filepath.Join(factory.Build.Application.Root, modules.ModulesDir)).NotTo(BeAnExistingFile())
 					Expect(filepath.Join(factory.Build.Application.Root, modules.CacheDir)).NotTo(BeADirectory())
 				})
 
 				it("contributes for the launch phase", func() {
-					factory.AddBuildPlan(modules.Dependency, buildplan.Dependency{
-						Metadata: buildplan.Metadata{"launch": true},
+					factory.AddPlan(buildpackplan.Plan{
+						Name:     modules.Dependency,
+						Metadata: buildpackplan.Metadata{"launch": true},
 					})
 
 					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
@@ -174,21 +316,468 @@ func testModules(t *testing.T, when spec.G, it spec.S) {
 
 					Expect(contributor.Contribute()).To(Succeed())
 
-					Expect(factory.Build.Layers).To(test.HaveLaunchMetadata(layers.Metadata{Processes: []layers.Process{{"web", "npm start"}}}))
+					Expect(factory.Build.Layers).To(test.HaveApplicationMetadata(layers.Metadata{Processes: []layers.Process{{Type: "web", Command: "npm start"}}}))
 
 					nodeModulesLayer := factory.Build.Layers.Layer(modules.Dependency)
 					Expect(nodeModulesLayer).To(test.HaveLayerMetadata(false, true, true))
 					Expect(filepath.Join(nodeModulesLayer.Root, modules.ModulesDir, "test_module")).To(BeARegularFile())
-					Expect(nodeModulesLayer).To(test.HaveOverrideSharedEnvironment("NODE_PATH", filepath.Join(nodeModulesLayer.Root, modules.ModulesDir)))
+					Expect(nodeModulesLayer).To(test.HaveOverrideLaunchEnvironment("NODE_PATH", filepath.Join(nodeModulesLayer.Root, modules.ModulesDir)))
+					Expect(nodeModulesLayer).To(test.HaveAppendPathLaunchEnvironment("PATH", filepath.Join(nodeModulesLayer.Root, modules.ModulesDir, ".bin")))
+					Expect(filepath.Join(nodeModulesLayer.Root, "profile.d", modules.NodeEnvProfile)).To(BeARegularFile())
 
 					npmCacheLayer := factory.Build.Layers.Layer(modules.Cache)
 					Expect(npmCacheLayer).To(test.HaveLayerMetadata(false, true, false))
 					Expect(filepath.Join(npmCacheLayer.Root, modules.CacheDir, "test_cache_item")).To(BeARegularFile())
 
-					Expect(filepath.Join(factory.Build.Application.Root, modules.ModulesDir)).NotTo(BeADirectory())
+					Expect(os.Readlink(filepath.Join(factory.Build.Application.Root, modules.ModulesDir))).To(Equal(filepath.Join(nodeModulesLayer.Root, modules.ModulesDir)))
 					Expect(filepath.Join(factory.Build.Application.Root, modules.CacheDir)).NotTo(BeADirectory())
 				})
 			})
+
+			when("the lockfile changes between builds", func() {
+				it("keeps the npm cache from the previous build", func() {
+					factory.AddPlan(buildpackplan.Plan{
+						Name:     modules.Dependency,
+						Metadata: buildpackplan.Metadata{"launch": true},
+					})
+
+					writeCacheItem := func(name string) func(_, _, location string) {
+						return func(_, _, location string) {
+							test.WriteFile(t, filepath.Join(location, modules.CacheDir, name), "some cache contents")
+						}
+					}
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(writeCacheItem("first_cache_item"))
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contributor.Contribute()).To(Succeed())
+
+					Expect(os.RemoveAll(filepath.Join(factory.Build.Application.Root, modules.ModulesDir))).To(Succeed())
+					test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"), "changed package lock")
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(writeCacheItem("second_cache_item"))
+					contributor, _, err = modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contributor.Contribute()).To(Succeed())
+
+					npmCacheLayer := factory.Build.Layers.Layer(modules.Cache)
+					Expect(filepath.Join(npmCacheLayer.Root, modules.CacheDir, "first_cache_item")).To(BeARegularFile())
+					Expect(filepath.Join(npmCacheLayer.Root, modules.CacheDir, "second_cache_item")).To(BeARegularFile())
+				})
+
+				it("discards the npm cache when its version changes", func() {
+					factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency})
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, location string) {
+						test.WriteFile(t, filepath.Join(location, modules.CacheDir, "old_cache_item"), "some cache contents")
+					})
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contributor.Contribute()).To(Succeed())
+
+					test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"), "changed package lock")
+
+					npmCacheLayer := factory.Build.Layers.Layer(modules.Cache)
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, _ string) {
+						Expect(filepath.Join(npmCacheLayer.Root, modules.CacheDir, "old_cache_item")).NotTo(BeAnExistingFile())
+					})
+					contributor, _, err = modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					contributor.NPMCacheMetadata.Hash = "next"
+					Expect(contributor.Contribute()).To(Succeed())
+				})
+			})
+
+			when("the app has native addons", func() {
+				var writeAddon func(location string)
+
+				it.Before(func() {
+					factory.AddPlan(buildpackplan.Plan{
+						Name:     modules.Dependency,
+						Metadata: buildpackplan.Metadata{"launch": true},
+					})
+
+					writeAddon = func(location string) {
+						addon := filepath.Join(location, modules.ModulesDir, "addon")
+						test.WriteFile(t, filepath.Join(addon, "package.json"), `{"name": "addon", "version": "1.0.0"}`)
+						test.WriteFile(t, filepath.Join(addon, "binding.gyp"), "{}")
+						test.WriteFile(t, filepath.Join(addon, "build", "Release", "addon.node"), "compiled")
+					}
+				})
+
+				it("caches compiled addons by node ABI", func() {
+					test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"),
+						`{"lockfileVersion": 1, "dependencies": {"addon": {"version": "1.0.0"}}}`)
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, location string) {
+						writeAddon(location)
+					})
+
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(contributor.Contribute()).To(Succeed())
+
+					name, version := contributor.NativeCacheMetadata.Identity()
+					Expect(name).To(Equal(modules.NativeCache))
+					Expect(version).To(Equal("64"))
+					Expect(contributor.NativeCacheMetadata.Arch).To(Equal(runtime.GOARCH))
+
+					nativeCacheLayer := factory.Build.Layers.Layer(modules.NativeCache)
+					Expect(nativeCacheLayer).To(test.HaveLayerMetadata(false, true, false))
+					Expect(filepath.Join(nativeCacheLayer.Root, modules.PrebuildsDir, "addon@1.0.0", "build", "Release", "addon.node")).To(BeARegularFile())
+					Expect(filepath.Join(nativeCacheLayer.Root, modules.NodeGypDir)).To(BeADirectory())
+				})
+
+				it("discards compiled addons from another architecture", func() {
+					test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"),
+						`{"lockfileVersion": 1, "dependencies": {"addon": {"version": "1.0.0"}}}`)
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, location string) {
+						writeAddon(location)
+					})
+
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contributor.Contribute()).To(Succeed())
+
+					Expect(os.Remove(filepath.Join(factory.Build.Application.Root, modules.ModulesDir))).To(Succeed())
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, location string) {
+						Expect(filepath.Join(location, modules.ModulesDir, "addon")).NotTo(BeAnExistingFile())
+					})
+
+					contributor, _, err = modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					contributor.NodeModulesMetadata.Arch = "s390x"
+					contributor.NativeCacheMetadata.Arch = "s390x"
+					Expect(contributor.Contribute()).To(Succeed())
+
+					nativeCacheLayer := factory.Build.Layers.Layer(modules.NativeCache)
+					Expect(filepath.Join(nativeCacheLayer.Root, modules.PrebuildsDir, "addon@1.0.0")).NotTo(BeAnExistingFile())
+				})
+
+				it("reuses compiled addons when the lockfile changes", func() {
+					lockfile := `{"lockfileVersion": 1, "dependencies": {"addon": {"version": "1.0.0"}, "other": {"version": "%s"}}}`
+					test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"), lockfile, "1.0.0")
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, location string) {
+						writeAddon(location)
+					})
+
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contributor.Contribute()).To(Succeed())
+
+					Expect(os.Remove(filepath.Join(factory.Build.Application.Root, modules.ModulesDir))).To(Succeed())
+					test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"), lockfile, "2.0.0")
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, location string) {
+						Expect(filepath.Join(location, modules.ModulesDir, "addon", "build", "Release", "addon.node")).To(BeARegularFile())
+					})
+
+					contributor, _, err = modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contributor.Contribute()).To(Succeed())
+				})
+
+				it("removes compiled addons of packages that left the lockfile", func() {
+					nativeCacheLayer := factory.Build.Layers.Layer(modules.NativeCache)
+					test.WriteFile(t, filepath.Join(nativeCacheLayer.Root, modules.PrebuildsDir, "addon@0.9.0", "binding.gyp"), "{}")
+					test.WriteFile(t, filepath.Join(nativeCacheLayer.Root, modules.PrebuildsDir, "@cnb", "removed@1.0.0", "binding.gyp"), "{}")
+					Expect(nativeCacheLayer.WriteMetadata(modules.Metadata{Name: modules.NativeCache, Hash: "64", Arch: runtime.GOARCH}, layers.Cache)).To(Succeed())
+					test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"),
+						`{"lockfileVersion": 1, "dependencies": {"addon": {"version": "1.0.0"}}}`)
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, location string) {
+						writeAddon(location)
+					})
+
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contributor.Contribute()).To(Succeed())
+
+					Expect(filepath.Join(nativeCacheLayer.Root, modules.PrebuildsDir, "addon@1.0.0")).To(BeADirectory())
+					Expect(filepath.Join(nativeCacheLayer.Root, modules.PrebuildsDir, "addon@0.9.0")).NotTo(BeAnExistingFile())
+					Expect(filepath.Join(nativeCacheLayer.Root, modules.PrebuildsDir, "@cnb")).NotTo(BeAnExistingFile())
+				})
+
+				it("discards node_modules built for another node ABI", func() {
+					test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"),
+						`{"lockfileVersion": 1, "dependencies": {"addon": {"version": "1.0.0"}}}`)
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, location string) {
+						writeAddon(location)
+					})
+
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contributor.NodeModulesMetadata.ABI).To(Equal("64"))
+					Expect(contributor.Contribute()).To(Succeed())
+
+					Expect(os.Remove(filepath.Join(factory.Build.Application.Root, modules.ModulesDir))).To(Succeed())
+
+					nodeModulesLayer := factory.Build.Layers.Layer(modules.Dependency)
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, location string) {
+						Expect(filepath.Join(nodeModulesLayer.Root, modules.ModulesDir)).NotTo(BeAnExistingFile())
+					})
+
+					contributor, _, err = modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					contributor.NodeModulesMetadata.ABI = "72"
+					contributor.NativeCacheMetadata.Hash = "72"
+					Expect(contributor.Contribute()).To(Succeed())
+				})
+
+				it("explains a failed install when the compiler toolchain is missing", func() {
+					path, err := ioutil.TempDir("", "empty-path")
+					Expect(err).NotTo(HaveOccurred())
+					defer os.RemoveAll(path)
+
+					defer os.Setenv("PATH", os.Getenv("PATH"))
+					Expect(os.Setenv("PATH", path)).To(Succeed())
+
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(_, _, location string) error {
+						writeAddon(location)
+						return errors.New("gyp ERR! build error")
+					})
+
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+
+					err = contributor.Contribute()
+					Expect(err).To(MatchError(ContainSubstring("native addons (addon@1.0.0) must be compiled")))
+					Expect(err).To(MatchError(ContainSubstring("make, g++ or c++, python3 or python")))
+				})
+			})
+
+			when("the lockfile has git dependencies", func() {
+				const commit = "0123456789abcdef0123456789abcdef01234567"
+
+				it.Before(func() {
+					test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"),
+						`{"lockfileVersion": 1, "dependencies": {"private": {"version": "git+ssh://git@github.com/org/private.git#%s"}}}`, commit)
+					factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency, Metadata: buildpackplan.Metadata{"launch": true}})
+				})
+
+				it("clones them into the git cache and points git at the clones", func() {
+					mockGit := NewMockGitClient(mockCtrl)
+					gitCacheLayer := factory.Build.Layers.Layer(modules.GitCache)
+
+					mockGit.EXPECT().Mirror("https://github.com/org/private.git", gomock.Any(), commit).DoAndReturn(func(_, dir, _ string) (bool, error) {
+						Expect(filepath.Dir(dir)).To(Equal(gitCacheLayer.Root))
+						// A clone cached for a dependency since removed from the lockfile
+						test.WriteFile(t, filepath.Join(gitCacheLayer.Root, "removed.git", "HEAD"), "ref: refs/heads/master")
+						return true, os.MkdirAll(dir, 0777)
+					})
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_, _, _ string) {
+						Expect(modules.GitEnv(gitCacheLayer)).To(Equal([]string{"XDG_CONFIG_HOME=" + gitCacheLayer.Root}))
+
+						config, err := ioutil.ReadFile(filepath.Join(gitCacheLayer.Root, "git", "config"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(config)).To(MatchRegexp(`^\[url "file://` + regexp.QuoteMeta(gitCacheLayer.Root) + `/[0-9a-f]+\.git"\]\n`))
+						Expect(string(config)).To(ContainSubstring("\tinsteadOf = ssh://git@github.com/org/private.git\n"))
+						Expect(string(config)).To(ContainSubstring("\tinsteadOf = https://github.com/org/private.git\n"))
+						Expect(string(config)).To(ContainSubstring("\tinsteadOf = git@github.com:org/private.git\n"))
+					})
+
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(contributor.HasGitDependencies()).To(BeTrue())
+					contributor.Git = mockGit
+
+					Expect(contributor.Contribute()).To(Succeed())
+
+					Expect(gitCacheLayer).To(test.HaveLayerMetadata(false, true, false))
+					Expect(filepath.Join(gitCacheLayer.Root, "removed.git")).NotTo(BeAnExistingFile())
+				})
+
+				it("clones over SSH first when there is a key, and falls back to HTTPS", func() {
+					mockGit := NewMockGitClient(mockCtrl)
+
+					gomock.InOrder(
+						mockGit.EXPECT().Mirror("ssh://git@github.com/org/private.git", gomock.Any(), commit).Return(true, errors.New("Permission denied (publickey)")),
+						mockGit.EXPECT().Mirror("https://github.com/org/private.git", gomock.Any(), commit).DoAndReturn(func(_, dir, _ string) (bool, error) {
+							return true, os.MkdirAll(dir, 0777)
+						}),
+					)
+					mockPkgManager.EXPECT().Install(gomock.Any(), gomock.Any(), gomock.Any())
+
+					contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).NotTo(HaveOccurred())
+					contributor.Git = mockGit
+					contributor.GitSSH = true
+
+					Expect(contributor.Contribute()).To(Succeed())
+				})
+
+				it("fails clearly when git is not on the stack", func() {
+					path, err := ioutil.TempDir("", "empty-path")
+					Expect(err).NotTo(HaveOccurred())
+					defer os.RemoveAll(path)
+
+					defer os.Setenv("PATH", os.Getenv("PATH"))
+					Expect(os.Setenv("PATH", path)).To(Succeed())
+
+					_, _, err = modules.NewContributor(factory.Build, mockPkgManager)
+					Expect(err).To(MatchError(ContainSubstring("has dependencies from git repositories (private), but git is not available on the stack")))
+				})
+			})
+		})
+	})
+
+	when("building with npm against a fixture registry", func() {
+		it("contributes node_modules and the npm cache", func() {
+			factory := test.NewBuildFactory(t)
+			factory.AddPlan(buildpackplan.Plan{
+				Name:     modules.Dependency,
+				Metadata: buildpackplan.Metadata{"launch": true},
+			})
+
+			test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"),
+				`{"dependencies": {"leftpad": {"version": "0.0.1", "resolved": "https://registry.npmjs.org/leftpad/-/leftpad-0.0.1.tgz"}}}`)
+
+			pkgManager := npm.NPM{
+				Runner: &fakenpm.Runner{Registry: filepath.Join("..", "integration", "fixtures", "registry")},
+				Logger: factory.Build.Logger,
+			}
+
+			contributor, willContribute, err := modules.NewContributor(factory.Build, pkgManager)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(willContribute).To(BeTrue())
+
+			Expect(contributor.Contribute()).To(Succeed())
+
+			nodeModulesLayer := factory.Build.Layers.Layer(modules.Dependency)
+			Expect(filepath.Join(nodeModulesLayer.Root, modules.ModulesDir, "leftpad", "index.js")).To(BeARegularFile())
+
+			npmCacheLayer := factory.Build.Layers.Layer(modules.Cache)
+			Expect(filepath.Join(npmCacheLayer.Root, modules.CacheDir, "_cacache", "index-v5")).To(BeADirectory())
+
+			Expect(filepath.Join(factory.Build.Application.Root, modules.ModulesDir, "leftpad", "index.js")).To(BeARegularFile())
+		})
+
+		it("includes the app's npm config in the node_modules identity", func() {
+			factory := test.NewBuildFactory(t)
+			factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency})
+
+			test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"), "{}")
+			pkgManager := npm.NPM{Runner: &fakenpm.Runner{}, Logger: factory.Build.Logger}
+
+			contributor, _, err := modules.NewContributor(factory.Build, pkgManager)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contributor.NodeModulesMetadata.Inputs).NotTo(HaveKey(npm.NPMRC))
+
+			test.WriteFile(t, filepath.Join(factory.Build.Application.Root, npm.NPMRC), "legacy-peer-deps=true")
+
+			contributor, _, err = modules.NewContributor(factory.Build, pkgManager)
+			Expect(err).NotTo(HaveOccurred())
+			config := contributor.NodeModulesMetadata.Inputs[npm.NPMRC]
+			Expect(config).NotTo(BeEmpty())
+
+			test.WriteFile(t, filepath.Join(factory.Build.Application.Root, npm.NPMRC), "legacy-peer-deps=true\n_auth=c2VjcmV0")
+
+			contributor, _, err = modules.NewContributor(factory.Build, pkgManager)
+			Expect(err).NotTo(HaveOccurred())
+			withCredential := contributor.NodeModulesMetadata.Inputs[npm.NPMRC]
+			Expect(withCredential).NotTo(Equal(config))
+
+			test.WriteFile(t, filepath.Join(factory.Build.Application.Root, npm.NPMRC), "legacy-peer-deps=true\n_auth=b3RoZXI=")
+
+			contributor, _, err = modules.NewContributor(factory.Build, pkgManager)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contributor.NodeModulesMetadata.Inputs[npm.NPMRC]).To(Equal(withCredential))
+
+			Expect(os.Setenv(modules.InputsEnv, "package.json")).To(Succeed())
+			defer os.Unsetenv(modules.InputsEnv)
+
+			contributor, _, err = modules.NewContributor(factory.Build, pkgManager)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contributor.NodeModulesMetadata.Inputs[npm.NPMRC]).To(Equal(withCredential))
+		})
+
+		when("the app has local dependencies", func() {
+			var factory *test.BuildFactory
+
+			it.Before(func() {
+				factory = test.NewBuildFactory(t)
+				factory.AddPlan(buildpackplan.Plan{
+					Name:     modules.Dependency,
+					Metadata: buildpackplan.Metadata{"launch": true},
+				})
+
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"),
+					`{"dependencies": {"shared": {"version": "file:lib/shared"}}}`)
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "lib", "shared", "package.json"), `{"name": "shared"}`)
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "lib", "shared", "index.js"), "module.exports = 1")
+			})
+
+			it("copies them into the layer", func() {
+				contributor, _, err := modules.NewContributor(factory.Build, npm.NPM{Runner: &fakenpm.Runner{}, Logger: factory.Build.Logger})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contributor.Contribute()).To(Succeed())
+
+				shared := filepath.Join(factory.Build.Layers.Layer(modules.Dependency).Root, modules.ModulesDir, "shared")
+				info, err := os.Lstat(shared)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.IsDir()).To(BeTrue())
+				Expect(filepath.Join(shared, "index.js")).To(BeARegularFile())
+			})
+
+			it("includes their contents in the node_modules identity", func() {
+				pkgManager := npm.NPM{Runner: &fakenpm.Runner{}, Logger: factory.Build.Logger}
+
+				contributor, _, err := modules.NewContributor(factory.Build, pkgManager)
+				Expect(err).NotTo(HaveOccurred())
+				first := contributor.NodeModulesMetadata.Inputs["file:lib/shared"]
+				Expect(first).NotTo(BeEmpty())
+
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "lib", "shared", modules.ModulesDir, "dep", "index.js"), "installed")
+
+				contributor, _, err = modules.NewContributor(factory.Build, pkgManager)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contributor.NodeModulesMetadata.Inputs["file:lib/shared"]).To(Equal(first))
+
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "lib", "shared", "index.js"), "module.exports = 2")
+
+				contributor, _, err = modules.NewContributor(factory.Build, pkgManager)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contributor.NodeModulesMetadata.Inputs["file:lib/shared"]).NotTo(Equal(first))
+			})
+
+			it("fails when they are missing", func() {
+				Expect(os.RemoveAll(filepath.Join(factory.Build.Application.Root, "lib"))).To(Succeed())
+
+				_, _, err := modules.NewContributor(factory.Build, npm.NPM{Runner: &fakenpm.Runner{}, Logger: factory.Build.Logger})
+				Expect(err).To(MatchError(`unable to read local dependencies: local dependency "lib/shared" does not exist; it must be pushed with the app`))
+			})
+		})
+
+		it("contributes the same node_modules layer from the same lockfile", func() {
+			build := func() string {
+				factory := test.NewBuildFactory(t)
+				factory.AddPlan(buildpackplan.Plan{
+					Name:     modules.Dependency,
+					Metadata: buildpackplan.Metadata{"launch": true},
+				})
+
+				test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"),
+					`{"dependencies": {"leftpad": {"version": "0.0.1"}, "@cnb/scripted": {"version": "1.0.0"}}}`)
+
+				pkgManager := npm.NPM{
+					Runner: &fakenpm.Runner{Registry: filepath.Join("..", "integration", "fixtures", "registry")},
+					Logger: factory.Build.Logger,
+				}
+
+				contributor, _, err := modules.NewContributor(factory.Build, pkgManager)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contributor.Contribute()).To(Succeed())
+
+				return treeDigest(t, filepath.Join(factory.Build.Layers.Layer(modules.Dependency).Root, modules.ModulesDir))
+			}
+
+			first := build()
+			Expect(build()).To(Equal(first))
 		})
 	})
 }
@@ -0,0 +1,272 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+	"github.com/cloudfoundry/libcfbuildpack/layers"
+)
+
+const (
+	NativeCache  = "native-cache"
+	NodeGypDir   = "node-gyp"
+	PrebuildsDir = "prebuilds"
+
+	// PrebuildMarker is written into each package restored from the native cache, so that its install scripts are not
+	// run to compile it again
+	PrebuildMarker = ".npm-cnb-prebuild"
+)
+
+// toolchain is what node-gyp needs on the stack to compile a native addon
+var toolchain = [][]string{{"make"}, {"g++", "c++"}, {"python3", "python"}}
+
+// NativeAddon is a package that compiles a binding.gyp when it is installed
+type NativeAddon struct {
+	Name    string
+	Version string
+	Path    string
+}
+
+func (n NativeAddon) String() string {
+	return fmt.Sprintf("%s@%s", n.Name, n.Version)
+}
+
+// FindNativeAddons returns every package under nodeModules that ships a binding.gyp
+func FindNativeAddons(nodeModules string) ([]NativeAddon, error) {
+	var addons []NativeAddon
+
+	if exists, err := helper.FileExists(nodeModules); err != nil || !exists {
+		return nil, err
+	}
+
+	err := filepath.Walk(nodeModules, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || info.Name() != "binding.gyp" {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		pkg := struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}{}
+		if err := json.Unmarshal(buf, &pkg); err != nil {
+			return fmt.Errorf("unable to parse %s: %s", filepath.Join(dir, "package.json"), err.Error())
+		}
+
+		addons = append(addons, NativeAddon{Name: pkg.Name, Version: pkg.Version, Path: dir})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(addons, func(i, j int) bool { return addons[i].Path < addons[j].Path })
+	return addons, nil
+}
+
+// MissingToolchain returns the compiler tools node-gyp needs that are not on the PATH
+func MissingToolchain() []string {
+	var missing []string
+
+	for _, alternatives := range toolchain {
+		found := false
+		for _, tool := range alternatives {
+			if _, err := exec.LookPath(tool); err == nil {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, strings.Join(alternatives, " or "))
+		}
+	}
+
+	return missing
+}
+
+// contributeNativeCache starts the layer afresh, since it is only contributed when the Node.js ABI or the architecture
+// changed and the cached headers and addons no longer apply
+func (c Contributor) contributeNativeCache(layer layers.Layer) error {
+	if err := os.RemoveAll(layer.Root); err != nil {
+		return fmt.Errorf("unable to clear native cache layer: %s", err.Error())
+	}
+
+	if err := os.MkdirAll(filepath.Join(layer.Root, NodeGypDir), 0777); err != nil {
+		return fmt.Errorf("unable to make node-gyp dir: %s", err.Error())
+	}
+
+	return os.MkdirAll(filepath.Join(layer.Root, PrebuildsDir), 0777)
+}
+
+// discardForeignNodeModules removes node_modules restored from a build for another Node.js ABI or architecture, which
+// npm would otherwise reuse along with the addons compiled in it
+func (c Contributor) discardForeignNodeModules(layer layers.Layer) error {
+	var previous Metadata
+	if err := layer.ReadMetadata(&previous); err != nil {
+		return fmt.Errorf("unable to read node_modules layer metadata: %s", err.Error())
+	}
+
+	if previous.Arch != "" && previous.Arch != c.NodeModulesMetadata.Arch {
+		c.nodeModulesLayer.Logger.Info("Discarding node_modules built for %s", previous.Arch)
+	} else if previous.ABI != "" && previous.ABI != c.NodeModulesMetadata.ABI {
+		c.nodeModulesLayer.Logger.Info("Discarding node_modules built for Node.js ABI %s", previous.ABI)
+	} else {
+		return nil
+	}
+
+	return os.RemoveAll(filepath.Join(layer.Root, ModulesDir))
+}
+
+// restorePrebuilds copies previously compiled addons that match the lockfile into the app so npm does not rebuild them
+func (c Contributor) restorePrebuilds() error {
+	for _, pkg := range c.lockfile {
+		prebuild := filepath.Join(c.nativeCacheLayer.Root, PrebuildsDir, fmt.Sprintf("%s@%s", pkg.Name, pkg.Version))
+
+		if exists, err := helper.FileExists(prebuild); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+
+		c.nativeCacheLayer.Logger.Info("Reusing compiled %s@%s", pkg.Name, pkg.Version)
+		dir := filepath.Join(c.app.Root, filepath.FromSlash(pkg.Path))
+		if err := helper.CopyDirectory(prebuild, dir); err != nil {
+			return fmt.Errorf("unable to restore compiled %s: %s", pkg.Name, err.Error())
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, PrebuildMarker), nil, 0644); err != nil {
+			return fmt.Errorf("unable to mark %s as restored: %s", pkg.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// savePrebuilds stores compiled addons in the native cache layer for builds against the same Node.js ABI
+func (c Contributor) savePrebuilds(addons []NativeAddon) error {
+	for _, addon := range addons {
+		if exists, err := helper.FileExists(filepath.Join(addon.Path, "build")); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(addon.Path, PrebuildMarker)); err != nil {
+			return err
+		}
+
+		prebuild := filepath.Join(c.nativeCacheLayer.Root, PrebuildsDir, addon.String())
+		if err := os.RemoveAll(prebuild); err != nil {
+			return err
+		}
+
+		if err := helper.CopyDirectory(addon.Path, prebuild); err != nil {
+			return fmt.Errorf("unable to cache compiled %s: %s", addon, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// prunePrebuilds removes the compiled addons of packages that are no longer in the lockfile, which would otherwise
+// accumulate in the native cache
+func (c Contributor) prunePrebuilds() error {
+	current := map[string]bool{}
+	for _, pkg := range c.lockfile {
+		current[fmt.Sprintf("%s@%s", pkg.Name, pkg.Version)] = true
+	}
+
+	root := filepath.Join(c.nativeCacheLayer.Root, PrebuildsDir)
+
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to list cached addons: %s", err.Error())
+	}
+
+	for _, entry := range entries {
+		// Scoped packages are cached as @scope/name@version
+		if strings.HasPrefix(entry.Name(), "@") && !strings.Contains(entry.Name()[1:], "@") {
+			if err := c.pruneScopedPrebuilds(root, entry.Name(), current); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !current[entry.Name()] {
+			if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+				return fmt.Errorf("unable to remove cached %s: %s", entry.Name(), err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c Contributor) pruneScopedPrebuilds(root, scope string, current map[string]bool) error {
+	entries, err := ioutil.ReadDir(filepath.Join(root, scope))
+	if err != nil {
+		return fmt.Errorf("unable to list cached addons: %s", err.Error())
+	}
+
+	kept := 0
+	for _, entry := range entries {
+		name := path.Join(scope, entry.Name())
+		if current[name] {
+			kept++
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("unable to remove cached %s: %s", name, err.Error())
+		}
+	}
+
+	if kept == 0 {
+		return os.RemoveAll(filepath.Join(root, scope))
+	}
+
+	return nil
+}
+
+// toolchainError explains a failed install in terms of the native addons that could not be compiled
+func toolchainError(err error, nodeModules string) error {
+	addons, findErr := FindNativeAddons(nodeModules)
+	if findErr != nil || len(addons) == 0 {
+		return err
+	}
+
+	missing := MissingToolchain()
+	if len(missing) == 0 {
+		return err
+	}
+
+	var names []string
+	for _, addon := range addons {
+		names = append(names, addon.String())
+	}
+
+	return fmt.Errorf("%s\nnative addons (%s) must be compiled, but the stack is missing a compiler toolchain: %s",
+		err.Error(), strings.Join(names, ", "), strings.Join(missing, ", "))
+}
@@ -0,0 +1,367 @@
+package modules
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CacheMaxSizeEnv caps the size of the npm cache layer, e.g. "512M" or "2G"
+	CacheMaxSizeEnv = "BP_NPM_CACHE_MAX_SIZE"
+
+	cacacheDir = "_cacache"
+	indexDir   = "index-v5"
+	contentDir = "content-v2"
+)
+
+type cacheEntry struct {
+	Key       string `json:"key"`
+	Integrity string `json:"integrity"`
+	Time      int64  `json:"time"`
+	Size      int64  `json:"size"`
+}
+
+type indexLine struct {
+	bucket string
+	line   string
+	entry  cacheEntry
+}
+
+// PruneCache removes npm cache entries for packages not in the lockfile, then evicts the oldest entries until the
+// cache fits in maxSize bytes (0 for no limit). When packages is nil only the size limit is applied. It returns
+// the number of bytes reclaimed.
+func PruneCache(npmCache string, packages []LockfilePackage, maxSize int64) (int64, error) {
+	root := filepath.Join(npmCache, cacacheDir)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	before, err := dirSize(root)
+	if err != nil {
+		return 0, err
+	}
+
+	lines, err := readIndex(filepath.Join(root, indexDir))
+	if err != nil {
+		return 0, err
+	}
+
+	var kept []indexLine
+	for _, l := range lines {
+		if l.entry.Integrity == "" {
+			continue
+		}
+
+		if packages == nil || referenced(l.entry, packages) {
+			kept = append(kept, l)
+		}
+	}
+
+	if maxSize > 0 {
+		if kept, err = evict(root, kept, maxSize); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := writeIndex(filepath.Join(root, indexDir), lines, kept); err != nil {
+		return 0, err
+	}
+
+	if err := removeUnreferencedContent(root, kept); err != nil {
+		return 0, err
+	}
+
+	after, err := dirSize(root)
+	if err != nil {
+		return 0, err
+	}
+
+	return before - after, nil
+}
+
+// ParseSize parses a byte count with an optional K, M or G suffix
+func ParseSize(value string) (int64, error) {
+	size := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	if size == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	if m, ok := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30}[size[len(size)-1]]; ok {
+		size = size[:len(size)-1]
+		multiplier = m
+	}
+
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return n * multiplier, nil
+}
+
+// FormatSize renders a byte count for the build log
+func FormatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+func referenced(entry cacheEntry, packages []LockfilePackage) bool {
+	for _, p := range packages {
+		if p.Integrity != "" && sharesDigest(entry.Integrity, p.Integrity) {
+			return true
+		}
+
+		if p.Resolved != "" && strings.HasSuffix(entry.Key, p.Resolved) {
+			return true
+		}
+
+		// packuments are keyed by the registry URL and the escaped package name
+		if strings.HasSuffix(entry.Key, "/"+strings.Replace(p.Name, "/", "%2f", 1)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sharesDigest(a, b string) bool {
+	for _, x := range strings.Fields(a) {
+		for _, y := range strings.Fields(b) {
+			if x == y {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func readIndex(index string) ([]indexLine, error) {
+	var lines []indexLine
+
+	if _, err := os.Stat(index); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	err := filepath.Walk(index, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), "\t", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			var entry cacheEntry
+			if err := json.Unmarshal([]byte(parts[1]), &entry); err != nil {
+				continue
+			}
+
+			lines = append(lines, indexLine{bucket: path, line: scanner.Text(), entry: entry})
+		}
+
+		return scanner.Err()
+	})
+
+	return lines, err
+}
+
+func writeIndex(index string, all, kept []indexLine) error {
+	buckets := map[string][]string{}
+	for _, l := range all {
+		buckets[l.bucket] = nil
+	}
+	for _, l := range kept {
+		buckets[l.bucket] = append(buckets[l.bucket], l.line)
+	}
+
+	for bucket, lines := range buckets {
+		if len(lines) == 0 {
+			if err := os.Remove(bucket); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		if err := ioutil.WriteFile(bucket, []byte("\n"+strings.Join(lines, "\n")), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func evict(root string, kept []indexLine, maxSize int64) ([]indexLine, error) {
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].entry.Time > kept[j].entry.Time })
+
+	var (
+		total  int64
+		seen   = map[string]bool{}
+		result []indexLine
+	)
+
+	for _, l := range kept {
+		size, paths, err := contentSize(root, l.entry.Integrity, seen)
+		if err != nil {
+			return nil, err
+		}
+
+		if total+size > maxSize {
+			continue
+		}
+
+		// Content is only counted once, for the first entry kept that refers to it
+		for _, path := range paths {
+			seen[path] = true
+		}
+
+		total += size
+		result = append(result, l)
+	}
+
+	return result, nil
+}
+
+// contentSize returns the size of the content an integrity refers to, other than that already seen, and the paths
+// of that content
+func contentSize(root, integrity string, seen map[string]bool) (int64, []string, error) {
+	var (
+		size  int64
+		paths []string
+	)
+
+	for _, path := range contentPaths(root, integrity) {
+		if seen[path] {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+
+		size += info.Size()
+		paths = append(paths, path)
+	}
+
+	return size, paths, nil
+}
+
+func removeUnreferencedContent(root string, kept []indexLine) error {
+	content := filepath.Join(root, contentDir)
+	if _, err := os.Stat(content); os.IsNotExist(err) {
+		return nil
+	}
+
+	keep := map[string]bool{}
+	for _, l := range kept {
+		for _, path := range contentPaths(root, l.entry.Integrity) {
+			keep[path] = true
+		}
+	}
+
+	return filepath.Walk(content, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || keep[path] {
+			return err
+		}
+
+		return os.Remove(path)
+	})
+}
+
+// contentPaths maps a subresource integrity string to the content-v2 files that hold it
+func contentPaths(root, integrity string) []string {
+	var paths []string
+
+	for _, sri := range strings.Fields(integrity) {
+		parts := strings.SplitN(sri, "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		digest, err := base64.StdEncoding.DecodeString(strings.SplitN(parts[1], "?", 2)[0])
+		if err != nil || len(digest) < 3 {
+			continue
+		}
+
+		h := hex.EncodeToString(digest)
+		paths = append(paths, filepath.Join(root, contentDir, parts[0], h[0:2], h[2:4], h[4:]))
+	}
+
+	return paths
+}
+
+// IndexBucket returns the index-v5 bucket file cacache uses for a key
+func IndexBucket(npmCache, key string) string {
+	h := sha256Hex(key)
+	return filepath.Join(npmCache, cacacheDir, indexDir, h[0:2], h[2:4], h[4:])
+}
+
+// IndexLine formats an entry the way cacache appends it to an index bucket
+func IndexLine(key, integrity string, size, time int64) string {
+	buf, _ := json.Marshal(cacheEntry{Key: key, Integrity: integrity, Time: time, Size: size})
+	h := sha1.Sum(buf)
+	return fmt.Sprintf("%s\t%s", hex.EncodeToString(h[:]), buf)
+}
+
+// ContentPath returns the content-v2 file cacache uses for an integrity string
+func ContentPath(npmCache, integrity string) string {
+	return contentPaths(filepath.Join(npmCache, cacacheDir), integrity)[0]
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
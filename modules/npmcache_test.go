@@ -0,0 +1,136 @@
+package modules_test
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/modules"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitNPMCache(t *testing.T) {
+	spec.Run(t, "NPMCache", testNPMCache, spec.Report(report.Terminal{}))
+}
+
+func testNPMCache(t *testing.T, when spec.G, it spec.S) {
+	var (
+		npmCache   string
+		writeEntry func(key, content string, time int64) string
+	)
+
+	it.Before(func() {
+		RegisterTestingT(t)
+
+		var err error
+		npmCache, err = ioutil.TempDir("", "npm-cache")
+		Expect(err).NotTo(HaveOccurred())
+
+		writeEntry = func(key, content string, time int64) string {
+			sum := sha512.Sum512([]byte(content))
+			integrity := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+
+			test.WriteFile(t, modules.ContentPath(npmCache, integrity), content)
+			test.WriteFile(t, modules.IndexBucket(npmCache, key), "\n%s", modules.IndexLine(key, integrity, int64(len(content)), time))
+
+			return modules.ContentPath(npmCache, integrity)
+		}
+	})
+
+	it.After(func() {
+		Expect(os.RemoveAll(npmCache)).To(Succeed())
+	})
+
+	when("pruning", func() {
+		var leftpad, rightpad string
+
+		it.Before(func() {
+			leftpad = writeEntry("make-fetch-happen:request-cache:https://registry.npmjs.org/leftpad/-/leftpad-0.0.1.tgz", "leftpad tarball", 2)
+			rightpad = writeEntry("make-fetch-happen:request-cache:https://registry.npmjs.org/rightpad/-/rightpad-1.0.0.tgz", "rightpad tarball", 1)
+		})
+
+		it("removes entries that are not in the lockfile", func() {
+			packages := []modules.LockfilePackage{
+				{Name: "leftpad", Version: "0.0.1", Resolved: "https://registry.npmjs.org/leftpad/-/leftpad-0.0.1.tgz"},
+			}
+
+			reclaimed, err := modules.PruneCache(npmCache, packages, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimed).To(BeNumerically(">=", len("rightpad tarball")))
+
+			Expect(leftpad).To(BeARegularFile())
+			Expect(rightpad).NotTo(BeAnExistingFile())
+		})
+
+		it("evicts the oldest entries to fit the maximum size", func() {
+			reclaimed, err := modules.PruneCache(npmCache, nil, int64(len("leftpad tarball")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimed).To(BeNumerically(">", 0))
+
+			Expect(leftpad).To(BeARegularFile())
+			Expect(rightpad).NotTo(BeAnExistingFile())
+		})
+
+		it("keeps everything when nothing is unreferenced and there is no limit", func() {
+			reclaimed, err := modules.PruneCache(npmCache, nil, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimed).To(BeZero())
+
+			Expect(leftpad).To(BeARegularFile())
+			Expect(rightpad).To(BeARegularFile())
+		})
+	})
+
+	when("entries share content", func() {
+		var tarball string
+
+		it.Before(func() {
+			tarball = writeEntry("make-fetch-happen:request-cache:https://registry.npmjs.org/leftpad/-/leftpad-0.0.1.tgz", "leftpad tarball", 2)
+			Expect(writeEntry("make-fetch-happen:request-cache:https://mirror.example.com/leftpad/-/leftpad-0.0.1.tgz", "leftpad tarball", 1)).To(Equal(tarball))
+		})
+
+		it("counts the content once when keeping both", func() {
+			reclaimed, err := modules.PruneCache(npmCache, nil, int64(len("leftpad tarball")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimed).To(BeZero())
+
+			Expect(tarball).To(BeARegularFile())
+		})
+
+		it("evicts both when the content does not fit", func() {
+			reclaimed, err := modules.PruneCache(npmCache, nil, int64(len("leftpad tarball"))-1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimed).To(BeNumerically(">=", len("leftpad tarball")))
+
+			Expect(tarball).NotTo(BeAnExistingFile())
+		})
+	})
+
+	when("there is no cache", func() {
+		it("does nothing", func() {
+			reclaimed, err := modules.PruneCache(filepath.Join(npmCache, "missing"), nil, 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reclaimed).To(BeZero())
+		})
+	})
+
+	when("parsing sizes", func() {
+		it("understands suffixes", func() {
+			Expect(modules.ParseSize("")).To(BeZero())
+			Expect(modules.ParseSize("1024")).To(Equal(int64(1024)))
+			Expect(modules.ParseSize("512M")).To(Equal(int64(512 << 20)))
+			Expect(modules.ParseSize("2gb")).To(Equal(int64(2 << 30)))
+		})
+
+		it("rejects garbage", func() {
+			_, err := modules.ParseSize("lots")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+}
@@ -0,0 +1,47 @@
+package modules
+
+import (
+	"github.com/buildpack/libbuildpack/buildpackplan"
+)
+
+// Node is the build plan entry provided by a Node.js engine buildpack
+const Node = "node"
+
+// MergePlans folds every buildpack plan entry for name into a single entry. More than one buildpack in a group can
+// require node_modules, so the "build" and "launch" flags are combined, while the version and any other metadata
+// come from the first entry that sets them.
+func MergePlans(entries []buildpackplan.Plan, name string) (buildpackplan.Plan, bool) {
+	merged := buildpackplan.Plan{Name: name, Metadata: buildpackplan.Metadata{}}
+	found := false
+
+	for _, entry := range entries {
+		if entry.Name != name {
+			continue
+		}
+		found = true
+
+		if merged.Version == "" {
+			merged.Version = entry.Version
+		}
+
+		for key, value := range entry.Metadata {
+			switch key {
+			case "build", "launch":
+				if flag(entry.Metadata, key) {
+					merged.Metadata[key] = true
+				}
+			default:
+				if _, ok := merged.Metadata[key]; !ok {
+					merged.Metadata[key] = value
+				}
+			}
+		}
+	}
+
+	return merged, found
+}
+
+func flag(metadata buildpackplan.Metadata, key string) bool {
+	value, _ := metadata[key].(bool)
+	return value
+}
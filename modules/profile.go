@@ -0,0 +1,61 @@
+package modules
+
+// NodeEnvProfile is the name of the profile.d script that defaults NODE_ENV for the launched application
+const NodeEnvProfile = "node_env.sh"
+
+// nodeEnvProfile defaults NODE_ENV to production while still honoring a value set on the container.
+const nodeEnvProfile = `export NODE_ENV="${NODE_ENV:-production}"
+`
+
+// LinkProfile is the name of the profile.d script that restores the app's node_modules link at launch
+const LinkProfile = "node_modules.sh"
+
+// linkProfile recreates the app's node_modules link when it is missing, leaving read-only app dirs to NODE_PATH.
+// It is a format string taking the app dir and the layer's node_modules dir.
+const linkProfile = `if [ ! -e "%[1]s/node_modules" ] && [ ! -L "%[1]s/node_modules" ] && [ -w "%[1]s" ]; then
+  ln -s "%[2]s" "%[1]s/node_modules" 2> /dev/null || true
+fi
+`
+
+// MemoryProfile is the name of the profile.d script that sizes the Node.js heap from the container memory limit
+const MemoryProfile = "memory.sh"
+
+// CgroupRootEnv overrides where the memory profile reads the container's cgroup memory limit from
+const CgroupRootEnv = "BP_NPM_CGROUP_ROOT"
+
+// memoryProfile sets --max-old-space-size to NODE_HEAP_PERCENT (default 75, with or without a trailing "%") of the
+// cgroup v2 or v1 memory limit, unless the application has already chosen a heap size in NODE_OPTIONS with either
+// spelling of the flag. A percentage that is not a whole number from 1 to 100 is reported and the default used instead.
+const memoryProfile = `case "${NODE_OPTIONS:-}" in
+  *--max-old-space-size*|*--max_old_space_size*) ;;
+  *)
+    cgroup="${BP_NPM_CGROUP_ROOT:-/sys/fs/cgroup}"
+    limit=""
+    if [ -r "$cgroup/memory.max" ]; then
+      limit=$(cat "$cgroup/memory.max")
+    elif [ -r "$cgroup/memory/memory.limit_in_bytes" ]; then
+      limit=$(cat "$cgroup/memory/memory.limit_in_bytes")
+    fi
+
+    percent="${NODE_HEAP_PERCENT:-75}"
+    percent="${percent%\%}"
+    case "$percent" in
+      ''|*[!0-9]*) percent=0 ;;
+      *) percent=$(expr "$percent" + 0) ;;
+    esac
+    if [ "$percent" -lt 1 ] || [ "$percent" -gt 100 ]; then
+      echo "Ignoring NODE_HEAP_PERCENT=$NODE_HEAP_PERCENT, which is not a percentage from 1 to 100; using 75" >&2
+      percent=75
+    fi
+
+    # cgroup v2 reports "max" and cgroup v1 reports a huge sentinel when there is no limit
+    if [ -n "$limit" ] && [ "$limit" != "max" ] && [ "$limit" -lt 1099511627776 ] 2>/dev/null; then
+      heap=$(( limit / 1048576 * percent / 100 ))
+      if [ "$heap" -gt 0 ]; then
+        export NODE_OPTIONS="${NODE_OPTIONS:+$NODE_OPTIONS }--max-old-space-size=$heap"
+      fi
+    fi
+    unset cgroup limit percent heap
+    ;;
+esac
+`
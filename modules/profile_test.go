@@ -0,0 +1,116 @@
+package modules_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildpack/libbuildpack/buildpackplan"
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/modules"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitProfile(t *testing.T) {
+	spec.Run(t, "Profile", testProfile, spec.Report(report.Terminal{}))
+}
+
+func testProfile(t *testing.T, when spec.G, it spec.S) {
+	var (
+		mockCtrl *gomock.Controller
+		script   string
+		cgroup   string
+	)
+
+	// heapOptions sources the memory profile with sh and returns the NODE_OPTIONS it exports
+	heapOptions := func(env ...string) string {
+		cmd := exec.Command("sh", "-c", `. "$0" && printf '%s' "$NODE_OPTIONS"`, script)
+		cmd.Env = append([]string{"PATH=" + os.Getenv("PATH"), modules.CgroupRootEnv + "=" + cgroup}, env...)
+
+		output, err := cmd.Output()
+		Expect(err).NotTo(HaveOccurred())
+		return string(output)
+	}
+
+	it.Before(func() {
+		RegisterTestingT(t)
+		mockCtrl = gomock.NewController(t)
+
+		factory := test.NewBuildFactory(t)
+		factory.AddPlan(buildpackplan.Plan{Name: modules.Dependency, Metadata: buildpackplan.Metadata{"launch": true}})
+		test.WriteFile(t, filepath.Join(factory.Build.Application.Root, "package-lock.json"), "{}")
+		test.WriteFile(t, filepath.Join(factory.Build.Application.Root, modules.ModulesDir, "test_module"), "some module")
+
+		mockPkgManager := NewMockPackageManager(mockCtrl)
+		mockPkgManager.EXPECT().NodeABI(gomock.Any()).Return("64", nil).AnyTimes()
+		mockPkgManager.EXPECT().Config(gomock.Any()).Return("", nil).AnyTimes()
+		mockPkgManager.EXPECT().Rebuild(factory.Build.Application.Root)
+
+		contributor, _, err := modules.NewContributor(factory.Build, mockPkgManager)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contributor.Contribute()).To(Succeed())
+
+		script = filepath.Join(factory.Build.Layers.Layer(modules.Dependency).Root, "profile.d", modules.MemoryProfile)
+
+		cgroup, err = ioutil.TempDir("", "cgroup")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	it.After(func() {
+		mockCtrl.Finish()
+		Expect(os.RemoveAll(cgroup)).To(Succeed())
+	})
+
+	when("the container has a cgroup v2 memory limit", func() {
+		it.Before(func() {
+			test.WriteFile(t, filepath.Join(cgroup, "memory.max"), "1073741824\n")
+		})
+
+		it("gives the heap 75% of the limit by default", func() {
+			Expect(heapOptions()).To(Equal("--max-old-space-size=768"))
+		})
+
+		it("uses NODE_HEAP_PERCENT, with or without a percent sign", func() {
+			Expect(heapOptions("NODE_HEAP_PERCENT=50")).To(Equal("--max-old-space-size=512"))
+			Expect(heapOptions("NODE_HEAP_PERCENT=50%")).To(Equal("--max-old-space-size=512"))
+		})
+
+		it("uses the default for a NODE_HEAP_PERCENT that is not a percentage", func() {
+			Expect(heapOptions("NODE_HEAP_PERCENT=lots")).To(Equal("--max-old-space-size=768"))
+			Expect(heapOptions("NODE_HEAP_PERCENT=150")).To(Equal("--max-old-space-size=768"))
+		})
+
+		it("keeps a heap size set in NODE_OPTIONS", func() {
+			Expect(heapOptions("NODE_OPTIONS=--max-old-space-size=100")).To(Equal("--max-old-space-size=100"))
+			Expect(heapOptions("NODE_OPTIONS=--max_old_space_size=100")).To(Equal("--max_old_space_size=100"))
+		})
+
+		it("appends to other NODE_OPTIONS", func() {
+			Expect(heapOptions("NODE_OPTIONS=--enable-source-maps")).To(Equal("--enable-source-maps --max-old-space-size=768"))
+		})
+	})
+
+	when("the container has no cgroup v2 memory limit", func() {
+		it("leaves the heap to node", func() {
+			test.WriteFile(t, filepath.Join(cgroup, "memory.max"), "max\n")
+			Expect(heapOptions()).To(BeEmpty())
+		})
+	})
+
+	when("the container has a cgroup v1 memory limit", func() {
+		it("gives the heap a share of the limit", func() {
+			test.WriteFile(t, filepath.Join(cgroup, "memory", "memory.limit_in_bytes"), "536870912\n")
+			Expect(heapOptions()).To(Equal("--max-old-space-size=384"))
+		})
+
+		it("leaves the heap to node when the limit is the unlimited sentinel", func() {
+			test.WriteFile(t, filepath.Join(cgroup, "memory", "memory.limit_in_bytes"), "9223372036854771712\n")
+			Expect(heapOptions()).To(BeEmpty())
+		})
+	})
+}
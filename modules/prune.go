@@ -0,0 +1,251 @@
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+)
+
+const (
+	// PruneEnv enables removing files that are not needed at runtime from the launch node_modules layer
+	PruneEnv = "BP_NPM_PRUNE"
+
+	// PruneIgnoreFile lists additional patterns to remove, or to keep with a leading "!", in the app root
+	PruneIgnoreFile = ".npmpruneignore"
+)
+
+// defaultPruneRules remove tests, documentation, source maps, TypeScript sources and tool configuration
+var defaultPruneRules = []string{
+	"test/", "tests/", "__tests__/", "__mocks__/", "coverage/", ".nyc_output/",
+	"doc/", "docs/", "example/", "examples/",
+	"*.md", "*.markdown",
+	"*.map", "*.ts", "*.tsx", "*.tsbuildinfo",
+	".github/", ".circleci/", ".travis.yml", ".editorconfig", ".eslintrc", ".eslintrc.*", ".eslintignore",
+	".prettierrc", ".prettierrc.*", ".jshintrc", ".npmignore", ".gitattributes", ".ds_store",
+}
+
+// defaultPruneFiles are documentation files without an extension. They only match files, since packages have source
+// directories with the same names, e.g. lib/history.
+var defaultPruneFiles = []string{"readme", "changelog", "changes", "history", "authors", "contributors"}
+
+// PruneRules decide which files in node_modules are removed. Like a .gitignore, a pattern without a "/" matches a
+// file or directory name anywhere, a pattern containing one matches the path relative to node_modules, a trailing
+// "/" only matches directories and a leading "!" keeps what earlier patterns removed. Matching ignores case.
+type PruneRules []pruneRule
+
+type pruneRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	fileOnly bool
+	anchored bool
+}
+
+// ParsePruneRules parses one pattern per line, skipping blank lines and "#" comments
+func ParsePruneRules(buf []byte) (PruneRules, error) {
+	var rules PruneRules
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := pruneRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		line = strings.TrimPrefix(line, "/")
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.ToLower(line)
+
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", scanner.Text(), err.Error())
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// LoadPruneRules returns the rules to prune with when PruneEnv is set, the built-in rules followed by any in the app's
+// PruneIgnoreFile, or nil when pruning is disabled
+func LoadPruneRules(appRoot string) (PruneRules, error) {
+	enabled, err := pruneEnabled(os.Getenv(PruneEnv))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", PruneEnv, err.Error())
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	rules, err := ParsePruneRules([]byte(strings.Join(defaultPruneRules, "\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ParsePruneRules([]byte(strings.Join(defaultPruneFiles, "\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range files {
+		rule.fileOnly = true
+		rules = append(rules, rule)
+	}
+
+	ignoreFile := filepath.Join(appRoot, PruneIgnoreFile)
+	if exists, err := helper.FileExists(ignoreFile); err != nil {
+		return nil, err
+	} else if !exists {
+		return rules, nil
+	}
+
+	buf, err := ioutil.ReadFile(ignoreFile)
+	if err != nil {
+		return nil, err
+	}
+
+	appRules, err := ParsePruneRules(buf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", PruneIgnoreFile, err.Error())
+	}
+
+	return append(rules, appRules...), nil
+}
+
+func pruneEnabled(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// Digest identifies the rules so that changing them rebuilds the node_modules layer
+func (r PruneRules) Digest() string {
+	if len(r) == 0 {
+		return ""
+	}
+
+	hash := sha256.New()
+	for _, rule := range r {
+		_, _ = fmt.Fprintf(hash, "%t %t %t %s\n", rule.negate, rule.dirOnly, rule.fileOnly, rule.pattern)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Prune removes the files and directories in nodeModules that the rules match, returning how many were removed and the
+// number of bytes reclaimed. Packages themselves, their package.json and .bin links are never removed.
+func (r PruneRules) Prune(nodeModules string) (int, int64, error) {
+	var (
+		removed   int
+		reclaimed int64
+	)
+
+	err := filepath.Walk(nodeModules, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == nodeModules {
+			return nil
+		}
+
+		rel, err := filepath.Rel(nodeModules, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if info.Name() == ".bin" {
+			return filepath.SkipDir
+		}
+
+		if packageStructure(rel) || info.Name() == "package.json" || !r.matches(rel, info.IsDir()) {
+			return nil
+		}
+
+		size, err := dirSize(p)
+		if err != nil {
+			return err
+		}
+
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+
+		removed++
+		reclaimed += size
+
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+
+	return removed, reclaimed, err
+}
+
+// matches applies every rule in order, so the last matching rule decides
+func (r PruneRules) matches(rel string, dir bool) bool {
+	rel = strings.ToLower(rel)
+	name := path.Base(rel)
+
+	prune := false
+	for _, rule := range r {
+		if (rule.dirOnly && !dir) || (rule.fileOnly && dir) {
+			continue
+		}
+
+		target := name
+		if rule.anchored {
+			target = rel
+		}
+
+		if ok, _ := path.Match(rule.pattern, target); ok {
+			prune = !rule.negate
+		}
+	}
+
+	return prune
+}
+
+// packageStructure reports whether rel is a package, scope or nested node_modules directory rather than a file inside
+// a package, so that a dependency named "test" or "docs" is never mistaken for a package's tests or docs
+func packageStructure(rel string) bool {
+	parts := strings.Split(rel, "/")
+	last := len(parts) - 1
+
+	if parts[last] == ModulesDir {
+		return true
+	}
+
+	if last == 0 || parts[last-1] == ModulesDir {
+		return true
+	}
+
+	return strings.HasPrefix(parts[last-1], "@") && (last == 1 || parts[last-2] == ModulesDir)
+}
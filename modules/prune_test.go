@@ -0,0 +1,141 @@
+package modules_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/modules"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitPrune(t *testing.T) {
+	spec.Run(t, "Prune", testPrune, spec.Report(report.Terminal{}))
+}
+
+func testPrune(t *testing.T, when spec.G, it spec.S) {
+	var appRoot, nodeModules string
+
+	it.Before(func() {
+		RegisterTestingT(t)
+
+		var err error
+		appRoot, err = ioutil.TempDir("", "app")
+		Expect(err).NotTo(HaveOccurred())
+
+		nodeModules = filepath.Join(appRoot, modules.ModulesDir)
+		Expect(os.Setenv(modules.PruneEnv, "true")).To(Succeed())
+	})
+
+	it.After(func() {
+		Expect(os.Unsetenv(modules.PruneEnv)).To(Succeed())
+		Expect(os.RemoveAll(appRoot)).To(Succeed())
+	})
+
+	when("modules.LoadPruneRules", func() {
+		it("returns no rules unless pruning is enabled", func() {
+			Expect(os.Unsetenv(modules.PruneEnv)).To(Succeed())
+
+			rules, err := modules.LoadPruneRules(appRoot)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(BeNil())
+			Expect(rules.Digest()).To(BeEmpty())
+		})
+
+		it("fails for an invalid setting", func() {
+			Expect(os.Setenv(modules.PruneEnv, "sometimes")).To(Succeed())
+
+			_, err := modules.LoadPruneRules(appRoot)
+			Expect(err).To(MatchError(ContainSubstring("unable to parse BP_NPM_PRUNE")))
+		})
+
+		it("changes the digest when the app adds rules", func() {
+			rules, err := modules.LoadPruneRules(appRoot)
+			Expect(err).NotTo(HaveOccurred())
+
+			test.WriteFile(t, filepath.Join(appRoot, modules.PruneIgnoreFile), "*.flow")
+			appRules, err := modules.LoadPruneRules(appRoot)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(appRules.Digest()).NotTo(Equal(rules.Digest()))
+		})
+	})
+
+	when("PruneRules.Prune", func() {
+		it.Before(func() {
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "package.json"), "{}")
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "index.js"), "module.exports = {}")
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "LICENSE"), "MIT")
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "CHANGELOG.md"), "0123456789")
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "index.js.map"), "{}")
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "test", "index.js"), "assert()")
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "docs", "api.txt"), "api")
+			test.WriteFile(t, filepath.Join(nodeModules, "test", "package.json"), "{}")
+			test.WriteFile(t, filepath.Join(nodeModules, "@types", "node", "index.d.ts"), "declare")
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "node_modules", "docs", "package.json"), "{}")
+		})
+
+		it("removes non-runtime files and reports the bytes reclaimed", func() {
+			rules, err := modules.LoadPruneRules(appRoot)
+			Expect(err).NotTo(HaveOccurred())
+
+			removed, reclaimed, err := rules.Prune(nodeModules)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(Equal(5))
+			Expect(reclaimed).To(Equal(int64(len("0123456789") + len("{}") + len("assert()") + len("api") + len("declare"))))
+
+			Expect(filepath.Join(nodeModules, "leftpad", "index.js")).To(BeARegularFile())
+			Expect(filepath.Join(nodeModules, "leftpad", "LICENSE")).To(BeARegularFile())
+			Expect(filepath.Join(nodeModules, "leftpad", "CHANGELOG.md")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(nodeModules, "leftpad", "index.js.map")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(nodeModules, "leftpad", "test")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(nodeModules, "leftpad", "docs")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(nodeModules, "@types", "node", "index.d.ts")).NotTo(BeAnExistingFile())
+		})
+
+		it("never removes packages that share a name with a rule", func() {
+			rules, err := modules.LoadPruneRules(appRoot)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = rules.Prune(nodeModules)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(nodeModules, "test", "package.json")).To(BeARegularFile())
+			Expect(filepath.Join(nodeModules, "@types", "node")).To(BeADirectory())
+			Expect(filepath.Join(nodeModules, "leftpad", "node_modules", "docs", "package.json")).To(BeARegularFile())
+		})
+
+		it("only removes documentation without an extension when it is a file", func() {
+			test.WriteFile(t, filepath.Join(nodeModules, "router", "HISTORY"), "history")
+			test.WriteFile(t, filepath.Join(nodeModules, "router", "lib", "history", "index.js"), "module.exports = {}")
+
+			rules, err := modules.LoadPruneRules(appRoot)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = rules.Prune(nodeModules)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(nodeModules, "router", "HISTORY")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(nodeModules, "router", "lib", "history", "index.js")).To(BeARegularFile())
+		})
+
+		it("applies the app's ignore file after the built-in rules", func() {
+			test.WriteFile(t, filepath.Join(nodeModules, "test", "LICENSE"), "MIT")
+			test.WriteFile(t, filepath.Join(appRoot, modules.PruneIgnoreFile), "# keep the docs\n!docs/\n\nleftpad/LICENSE\n")
+
+			rules, err := modules.LoadPruneRules(appRoot)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = rules.Prune(nodeModules)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(nodeModules, "leftpad", "docs", "api.txt")).To(BeARegularFile())
+			Expect(filepath.Join(nodeModules, "leftpad", "LICENSE")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(nodeModules, "test", "LICENSE")).To(BeARegularFile())
+		})
+	})
+}
@@ -0,0 +1,96 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// NormalizedTime is the modification time given to every file in the node_modules layer, matching the time the
+// lifecycle gives to files in exported layers
+var NormalizedTime = time.Date(1980, time.January, 1, 0, 0, 1, 0, time.UTC)
+
+// installFields are package.json fields npm adds that record the directory and command of the install, so they differ
+// between otherwise identical builds
+var installFields = []string{"_where", "_args"}
+
+// Normalize removes the files npm writes that differ between installs of the same lockfile, strips install specific
+// fields from package manifests and resets modification times so the same lockfile always produces the same layer
+func Normalize(nodeModules string) error {
+	var dirs []string
+
+	err := filepath.Walk(nodeModules, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := info.Name()
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			return nil
+		case info.IsDir():
+			dirs = append(dirs, path)
+			return nil
+		case path == filepath.Join(nodeModules, ".package-lock.json"), strings.HasPrefix(name, "npm-debug.log"):
+			return os.Remove(path)
+		case name == "package.json":
+			if err := stripInstallFields(path, info.Mode()); err != nil {
+				return err
+			}
+		}
+
+		return os.Chtimes(path, NormalizedTime, NormalizedTime)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directories are reset last, deepest first, since removing and rewriting files updates their parents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i], NormalizedTime, NormalizedTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func stripInstallFields(path string, mode os.FileMode) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	manifest := map[string]json.RawMessage{}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		// Fixtures and templates inside packages are not always valid JSON and are left as they are
+		return nil
+	}
+
+	stripped := false
+	for _, field := range installFields {
+		if _, ok := manifest[field]; ok {
+			delete(manifest, field)
+			stripped = true
+		}
+	}
+
+	if !stripped {
+		return nil
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, out.Bytes(), mode)
+}
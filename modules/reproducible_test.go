@@ -0,0 +1,126 @@
+package modules_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/modules"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+func TestUnitReproducible(t *testing.T) {
+	spec.Run(t, "Reproducible", testReproducible, spec.Report(report.Terminal{}))
+}
+
+func testReproducible(t *testing.T, when spec.G, it spec.S) {
+	var nodeModules string
+
+	it.Before(func() {
+		RegisterTestingT(t)
+
+		var err error
+		nodeModules, err = ioutil.TempDir("", "node_modules")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	it.After(func() {
+		Expect(os.RemoveAll(nodeModules)).To(Succeed())
+	})
+
+	when("modules.Normalize", func() {
+		it("strips install specific fields from package manifests", func() {
+			manifest := filepath.Join(nodeModules, "leftpad", "package.json")
+			test.WriteFile(t, manifest, `{"name": "leftpad", "version": "0.0.1", "_where": "/tmp/app", "_args": [["leftpad@0.0.1", "/tmp/app"]], "_resolved": "https://registry/leftpad.tgz"}`)
+
+			Expect(modules.Normalize(nodeModules)).To(Succeed())
+
+			Expect(ioutil.ReadFile(manifest)).To(MatchJSON(`{"name": "leftpad", "version": "0.0.1", "_resolved": "https://registry/leftpad.tgz"}`))
+		})
+
+		it("leaves manifests without install specific fields untouched", func() {
+			manifest := filepath.Join(nodeModules, "leftpad", "package.json")
+			test.WriteFile(t, manifest, `{"version": "0.0.1", "name": "leftpad"}`)
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "fixtures", "package.json"), "not json")
+
+			Expect(modules.Normalize(nodeModules)).To(Succeed())
+
+			Expect(ioutil.ReadFile(manifest)).To(Equal([]byte(`{"version": "0.0.1", "name": "leftpad"}`)))
+		})
+
+		it("removes files that differ between installs", func() {
+			test.WriteFile(t, filepath.Join(nodeModules, ".package-lock.json"), "{}")
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "npm-debug.log"), "log")
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", ".package-lock.json"), "{}")
+
+			Expect(modules.Normalize(nodeModules)).To(Succeed())
+
+			Expect(filepath.Join(nodeModules, ".package-lock.json")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(nodeModules, "leftpad", "npm-debug.log")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(nodeModules, "leftpad", ".package-lock.json")).To(BeARegularFile())
+		})
+
+		it("resets modification times", func() {
+			test.WriteFile(t, filepath.Join(nodeModules, "leftpad", "index.js"), "module.exports = {}")
+			Expect(os.Symlink(filepath.Join("..", "leftpad", "index.js"), filepath.Join(nodeModules, "leftpad-link"))).To(Succeed())
+
+			Expect(modules.Normalize(nodeModules)).To(Succeed())
+
+			for _, path := range []string{nodeModules, filepath.Join(nodeModules, "leftpad"), filepath.Join(nodeModules, "leftpad", "index.js")} {
+				info, err := os.Stat(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.ModTime().Equal(modules.NormalizedTime)).To(BeTrue(), path)
+			}
+		})
+	})
+}
+
+// treeDigest hashes the names, modes, modification times, link targets and contents of every file under root
+func treeDigest(t *testing.T, root string) string {
+	t.Helper()
+
+	hash := sha256.New()
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		_, _ = fmt.Fprintf(hash, "%s %s", rel, info.Mode())
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(hash, " -> %s\n", target)
+			return nil
+		}
+
+		_, _ = fmt.Fprintf(hash, " %d\n", info.ModTime().UnixNano())
+
+		if info.Mode().IsRegular() {
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			_, _ = hash.Write(buf)
+		}
+
+		return nil
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
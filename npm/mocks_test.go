@@ -52,6 +52,26 @@ func (mr *MockRunnerMockRecorder) Run(bin, dir interface{}, args ...interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Run", reflect.TypeOf((*MockRunner)(nil).Run), varargs...)
 }
 
+// RunWithOutput mocks base method
+func (m *MockRunner) RunWithOutput(bin, dir string, args ...string) (string, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{bin, dir}
+	for _, a := range args {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "RunWithOutput", varargs...)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RunWithOutput indicates an expected call of RunWithOutput
+func (mr *MockRunnerMockRecorder) RunWithOutput(bin, dir interface{}, args ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{bin, dir}, args...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RunWithOutput", reflect.TypeOf((*MockRunner)(nil).RunWithOutput), varargs...)
+}
+
 // MockLogger is a mock of Logger interface
 type MockLogger struct {
 	ctrl     *gomock.Controller
@@ -3,13 +3,19 @@ package npm
 import (
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/cloudfoundry/libcfbuildpack/helper"
+	"github.com/cloudfoundry/npm-cnb/metrics"
 	"github.com/cloudfoundry/npm-cnb/modules"
 )
 
+// RegistryEnv points npm at a registry other than the one configured for the app, e.g. a local test registry
+const RegistryEnv = "BP_NPM_REGISTRY"
+
 type Runner interface {
 	Run(bin, dir string, args ...string) error
+	RunWithOutput(bin, dir string, args ...string) (string, error)
 }
 
 type Logger interface {
@@ -18,29 +24,92 @@ type Logger interface {
 
 type NPM struct {
 	Runner Runner
-	Logger Logger
+
+	// ScriptRunner runs the install scripts of allowlisted dependencies, falling back to Runner
+	ScriptRunner Runner
+
+	Logger  Logger
+	Metrics *metrics.Recorder
 }
 
 func (n NPM) Install(modulesLayer, cacheLayer, location string) error {
-	if err := n.moveDir(modulesLayer, location, modules.ModulesDir); err != nil {
+	npmCache := filepath.Join(location, modules.CacheDir)
+
+	if err := n.Metrics.Time("restore node_modules", func() error {
+		return n.moveDir(modulesLayer, location, modules.ModulesDir)
+	}); err != nil {
 		return err
 	}
 
-	if err := n.moveDir(cacheLayer, location, modules.CacheDir); err != nil {
+	if err := n.Metrics.Time("restore npm-cache", func() error {
+		return n.moveDir(cacheLayer, location, modules.CacheDir)
+	}); err != nil {
 		return err
 	}
 
-	npmCache := filepath.Join(location, modules.CacheDir)
+	args := append([]string{"install"}, ignoreScripts()...)
+	args = append(args, "--cache", npmCache)
+	if registry := os.Getenv(RegistryEnv); registry != "" {
+		args = append(args, "--registry", registry)
+	}
+
+	if err := n.Metrics.Time("npm install", func() error {
+		return n.Runner.Run("npm", location, args...)
+	}); err != nil {
+		return err
+	}
+
+	if err := n.runScripts(location, true); err != nil {
+		return err
+	}
+
+	if err := n.runAppScripts(location); err != nil {
+		return err
+	}
 
-	if err := n.Runner.Run("npm", location, "install", "--unsafe-perm", "--cache", npmCache); err != nil {
+	verify, skipped, err := shouldVerify(npmCache)
+	if err != nil {
 		return err
 	}
 
-	return n.Runner.Run("npm", location, "cache", "verify", "--cache", npmCache)
+	if !verify {
+		n.Logger.Info("Skipping npm cache verify")
+		return recordVerify(npmCache, skipped)
+	}
+
+	if err := n.Metrics.Time("npm cache verify", func() error {
+		return n.Runner.Run("npm", location, "cache", "verify", "--cache", npmCache)
+	}); err != nil {
+		return err
+	}
+
+	digest, err := cacheDigest(npmCache)
+	if err != nil {
+		return err
+	}
+
+	return recordVerify(npmCache, verifyState{Digest: digest})
 }
 
 func (n NPM) Rebuild(location string) error {
-	return n.Runner.Run("npm", location, "rebuild")
+	if err := n.Metrics.Time("npm rebuild", func() error {
+		return n.Runner.Run("npm", location, append([]string{"rebuild"}, ignoreScripts()...)...)
+	}); err != nil {
+		return err
+	}
+
+	// Vendored addons may have been compiled elsewhere, so they are always rebuilt
+	return n.runScripts(location, false)
+}
+
+// NodeABI returns the native module ABI version of the node on the PATH, as used by compiled addons
+func (n NPM) NodeABI(location string) (string, error) {
+	abi, err := n.Runner.RunWithOutput("node", location, "-p", "process.versions.modules")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(abi), nil
 }
 
 func (n NPM) moveDir(source, target, name string) error {
@@ -6,6 +6,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/fakenpm"
 	"github.com/cloudfoundry/npm-cnb/modules"
 	"github.com/cloudfoundry/npm-cnb/npm"
 	"github.com/golang/mock/gomock"
@@ -49,7 +51,7 @@ func testNPM(t *testing.T, when spec.G, it spec.S) {
 				location := filepath.Join("some", "fake", "dir")
 
 				npmCache := filepath.Join(location, modules.CacheDir)
-				mockRunner.EXPECT().Run("npm", location, "install", "--unsafe-perm", "--cache", npmCache)
+				mockRunner.EXPECT().Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache)
 				mockRunner.EXPECT().Run("npm", location, "cache", "verify", "--cache", npmCache)
 
 				Expect(pkgManager.Install("", "", location)).To(Succeed())
@@ -77,7 +79,7 @@ func testNPM(t *testing.T, when spec.G, it spec.S) {
 				Expect(ioutil.WriteFile(filepath.Join(cacheLayer, modules.CacheDir, "cache-item"), []byte(""), os.ModePerm)).To(Succeed())
 
 				npmCache := filepath.Join(location, modules.CacheDir)
-				mockRunner.EXPECT().Run("npm", location, "install", "--unsafe-perm", "--cache", npmCache)
+				mockRunner.EXPECT().Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache)
 				mockRunner.EXPECT().Run("npm", location, "cache", "verify", "--cache", npmCache)
 
 				Expect(pkgManager.Install(modulesLayer, cacheLayer, location)).To(Succeed())
@@ -91,6 +93,347 @@ func testNPM(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 
+	when("a registry is configured", func() {
+		it.After(func() {
+			Expect(os.Unsetenv(npm.RegistryEnv)).To(Succeed())
+		})
+
+		it("should install from that registry", func() {
+			Expect(os.Setenv(npm.RegistryEnv, "http://127.0.0.1:8080")).To(Succeed())
+
+			location := filepath.Join("some", "fake", "dir")
+			npmCache := filepath.Join(location, modules.CacheDir)
+
+			mockRunner.EXPECT().Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache, "--registry", "http://127.0.0.1:8080")
+			mockRunner.EXPECT().Run("npm", location, "cache", "verify", "--cache", npmCache)
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+		})
+	})
+
+	when("installing against a fixture registry", func() {
+		it("should install node_modules and reuse them on the next install", func() {
+			location, err := ioutil.TempDir("", "")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(location)
+
+			test.WriteFile(t, filepath.Join(location, "package-lock.json"),
+				`{"dependencies": {"leftpad": {"version": "0.0.1", "resolved": "https://registry.npmjs.org/leftpad/-/leftpad-0.0.1.tgz"}}}`)
+
+			runner := &fakenpm.Runner{Registry: filepath.Join("..", "integration", "fixtures", "registry")}
+			pkgManager := npm.NPM{Runner: runner, Logger: mockLogger}
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+			Expect(filepath.Join(location, modules.ModulesDir, "leftpad", "index.js")).To(BeARegularFile())
+
+			runner.Registry = filepath.Join(location, "empty-registry")
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+		})
+	})
+
+	when("running install scripts", func() {
+		var (
+			location string
+			runner   *fakenpm.Runner
+		)
+
+		it.Before(func() {
+			var err error
+			location, err = ioutil.TempDir("", "")
+			Expect(err).NotTo(HaveOccurred())
+
+			test.WriteFile(t, filepath.Join(location, "package.json"), `{"name": "app", "scripts": {"postinstall": "node build.js", "start": "node server.js"}}`)
+			test.WriteFile(t, filepath.Join(location, "package-lock.json"),
+				`{"dependencies": {"leftpad": {"version": "0.0.1"}, "@cnb/scripted": {"version": "1.0.0"}}}`)
+
+			runner = &fakenpm.Runner{Registry: filepath.Join("..", "integration", "fixtures", "registry")}
+			pkgManager = npm.NPM{Runner: runner, Logger: mockLogger}
+		})
+
+		it.After(func() {
+			Expect(os.RemoveAll(location)).To(Succeed())
+			Expect(os.Unsetenv(npm.ScriptsAllowlistEnv)).To(Succeed())
+		})
+
+		it("should only run the app's own scripts by default", func() {
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+
+			Expect(runner.Calls()[0]).To(ContainElement("--ignore-scripts"))
+			Expect(runner.Scripts()).To(Equal([]string{"app:postinstall"}))
+		})
+
+		it("should run the scripts of allowlisted packages", func() {
+			Expect(os.Setenv(npm.ScriptsAllowlistEnv, "leftpad, @cnb/scripted")).To(Succeed())
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+
+			Expect(runner.Calls()).To(ContainElement([]string{"npm", "rebuild", "@cnb/scripted"}))
+			Expect(runner.Scripts()).To(Equal([]string{"@cnb/scripted:postinstall", "app:postinstall"}))
+		})
+
+		it("should run the scripts of allowlisted packages with the script runner", func() {
+			Expect(os.Setenv(npm.ScriptsAllowlistEnv, "@cnb/scripted")).To(Succeed())
+
+			scriptRunner := &fakenpm.Runner{Registry: runner.Registry}
+			pkgManager.ScriptRunner = scriptRunner
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+
+			Expect(scriptRunner.Calls()).To(Equal([][]string{{"npm", "rebuild", "@cnb/scripted"}}))
+			Expect(runner.Calls()).NotTo(ContainElement([]string{"npm", "rebuild", "@cnb/scripted"}))
+			Expect(scriptRunner.Scripts()).To(Equal([]string{"@cnb/scripted:postinstall"}))
+		})
+
+		it("should let npm run every script when all packages are allowed", func() {
+			Expect(os.Setenv(npm.ScriptsAllowlistEnv, "*")).To(Succeed())
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+
+			Expect(runner.Calls()[0]).NotTo(ContainElement("--ignore-scripts"))
+			Expect(runner.Scripts()).To(Equal([]string{"@cnb/scripted:postinstall"}))
+		})
+
+		it("should run the scripts of allowlisted packages when rebuilding", func() {
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+			Expect(os.Setenv(npm.ScriptsAllowlistEnv, "@cnb/scripted")).To(Succeed())
+
+			Expect(pkgManager.Rebuild(location)).To(Succeed())
+
+			Expect(runner.Calls()).To(ContainElement([]string{"npm", "rebuild", "--ignore-scripts"}))
+			Expect(runner.Scripts()).To(Equal([]string{"app:postinstall", "@cnb/scripted:postinstall"}))
+		})
+
+		it("should not run the scripts of native addons restored compiled from the native cache", func() {
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+			scripted := filepath.Join(location, modules.ModulesDir, "@cnb", "scripted")
+			test.WriteFile(t, filepath.Join(scripted, "binding.gyp"), "{}")
+			test.WriteFile(t, filepath.Join(scripted, "build", "Release", "scripted.node"), "compiled")
+			test.WriteFile(t, filepath.Join(scripted, modules.PrebuildMarker), "")
+			Expect(os.Setenv(npm.ScriptsAllowlistEnv, "@cnb/scripted")).To(Succeed())
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+
+			Expect(runner.Calls()).NotTo(ContainElement([]string{"npm", "rebuild", "@cnb/scripted"}))
+			Expect(runner.Scripts()).NotTo(ContainElement("@cnb/scripted:postinstall"))
+			Expect(filepath.Join(scripted, modules.PrebuildMarker)).NotTo(BeAnExistingFile())
+		})
+
+		it("should run the scripts of allowlisted native addons that were not restored", func() {
+			scripted := filepath.Join(location, modules.ModulesDir, "@cnb", "scripted")
+			test.WriteFile(t, filepath.Join(scripted, "binding.gyp"), "{}")
+			test.WriteFile(t, filepath.Join(scripted, "build", "Release", "scripted.node"), "compiled elsewhere")
+			Expect(os.Setenv(npm.ScriptsAllowlistEnv, "@cnb/scripted")).To(Succeed())
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+
+			Expect(runner.Calls()).To(ContainElement([]string{"npm", "rebuild", "@cnb/scripted"}))
+		})
+
+		it("should always run the scripts of allowlisted vendored native addons when rebuilding", func() {
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+			scripted := filepath.Join(location, modules.ModulesDir, "@cnb", "scripted")
+			test.WriteFile(t, filepath.Join(scripted, "binding.gyp"), "{}")
+			test.WriteFile(t, filepath.Join(scripted, "build", "Release", "scripted.node"), "compiled on another machine")
+			test.WriteFile(t, filepath.Join(scripted, modules.PrebuildMarker), "")
+			Expect(os.Setenv(npm.ScriptsAllowlistEnv, "@cnb/scripted")).To(Succeed())
+
+			Expect(pkgManager.Rebuild(location)).To(Succeed())
+
+			Expect(runner.Calls()).To(ContainElement([]string{"npm", "rebuild", "@cnb/scripted"}))
+			Expect(runner.Scripts()).To(ContainElement("@cnb/scripted:postinstall"))
+		})
+	})
+
+	when("finding packages with install scripts", func() {
+		it("should include packages that compile a binding.gyp", func() {
+			nodeModules, err := ioutil.TempDir("", "")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(nodeModules)
+
+			test.WriteFile(t, filepath.Join(nodeModules, "plain", "package.json"), `{"name": "plain", "scripts": {"test": "mocha"}}`)
+			test.WriteFile(t, filepath.Join(nodeModules, "scripted", "package.json"), `{"name": "scripted", "scripts": {"install": "node install.js"}}`)
+			test.WriteFile(t, filepath.Join(nodeModules, "addon", "package.json"), `{"name": "addon"}`)
+			test.WriteFile(t, filepath.Join(nodeModules, "addon", "binding.gyp"), "{}")
+			test.WriteFile(t, filepath.Join(nodeModules, "addon", "test", "fixture", "package.json"), `{"scripts": {"install": "x"}}`)
+
+			Expect(npm.ScriptedPackages(nodeModules)).To(Equal([]string{"addon", "scripted"}))
+		})
+	})
+
+	when("verifying the npm cache", func() {
+		var location, npmCache string
+
+		it.Before(func() {
+			var err error
+			location, err = ioutil.TempDir("", "")
+			Expect(err).NotTo(HaveOccurred())
+
+			npmCache = filepath.Join(location, modules.CacheDir)
+			index := filepath.Join(npmCache, "_cacache", "index-v5", "aa", "bb")
+			Expect(os.MkdirAll(index, os.ModePerm)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(index, "cc"), []byte("entry"), os.ModePerm)).To(Succeed())
+		})
+
+		it.After(func() {
+			Expect(os.RemoveAll(location)).To(Succeed())
+			Expect(os.Unsetenv(npm.CacheVerifyEnv)).To(Succeed())
+		})
+
+		it("should skip verify when the cache has not changed since it was last verified", func() {
+			mockRunner.EXPECT().Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache).Times(2)
+			mockRunner.EXPECT().Run("npm", location, "cache", "verify", "--cache", npmCache).Times(1)
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+		})
+
+		it("should verify again when the cache has changed", func() {
+			mockRunner.EXPECT().Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache).Times(2)
+			mockRunner.EXPECT().Run("npm", location, "cache", "verify", "--cache", npmCache).Times(2)
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(npmCache, "_cacache", "index-v5", "aa", "bb", "dd"), []byte("new entry"), os.ModePerm)).To(Succeed())
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+		})
+
+		it("should verify every build when configured to always verify", func() {
+			Expect(os.Setenv(npm.CacheVerifyEnv, "always")).To(Succeed())
+
+			mockRunner.EXPECT().Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache).Times(2)
+			mockRunner.EXPECT().Run("npm", location, "cache", "verify", "--cache", npmCache).Times(2)
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+		})
+
+		it("should never verify when configured not to", func() {
+			Expect(os.Setenv(npm.CacheVerifyEnv, "never")).To(Succeed())
+
+			mockRunner.EXPECT().Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache)
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+		})
+
+		it("should verify every Nth build", func() {
+			Expect(os.Setenv(npm.CacheVerifyEnv, "2")).To(Succeed())
+
+			mockRunner.EXPECT().Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache).Times(3)
+			mockRunner.EXPECT().Run("npm", location, "cache", "verify", "--cache", npmCache).Times(2)
+
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+			Expect(pkgManager.Install("", "", location)).To(Succeed())
+		})
+
+		it("should reject an invalid setting", func() {
+			Expect(os.Setenv(npm.CacheVerifyEnv, "sometimes")).To(Succeed())
+
+			mockRunner.EXPECT().Run("npm", location, "install", "--ignore-scripts", "--cache", npmCache)
+
+			Expect(pkgManager.Install("", "", location)).To(MatchError(ContainSubstring(npm.CacheVerifyEnv)))
+		})
+	})
+
+	when("determining the node ABI", func() {
+		it("should ask node for its modules version", func() {
+			location := filepath.Join("some", "fake", "dir")
+
+			mockRunner.EXPECT().RunWithOutput("node", location, "-p", "process.versions.modules").Return("64\n", nil)
+
+			Expect(pkgManager.NodeABI(location)).To(Equal("64"))
+		})
+	})
+
+	when("reading the app's npm config", func() {
+		var location string
+
+		it.Before(func() {
+			var err error
+			location, err = ioutil.TempDir("", "")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		it.After(func() {
+			Expect(os.RemoveAll(location)).To(Succeed())
+			Expect(os.Unsetenv(npm.RegistryEnv)).To(Succeed())
+		})
+
+		config := func(npmrc string) string {
+			test.WriteFile(t, filepath.Join(location, npm.NPMRC), npmrc)
+
+			digest, err := pkgManager.Config(location)
+			Expect(err).NotTo(HaveOccurred())
+			return digest
+		}
+
+		it("should return no config when there is no .npmrc", func() {
+			Expect(pkgManager.Config(location)).To(BeEmpty())
+		})
+
+		it("should identify the settings", func() {
+			digest := config("legacy-peer-deps=true\nengine-strict = true\n")
+
+			Expect(digest).NotTo(BeEmpty())
+			Expect(config("; reordered\nengine-strict=true\nlegacy-peer-deps=true\n")).To(Equal(digest))
+			Expect(config("legacy-peer-deps=false\nengine-strict=true\n")).NotTo(Equal(digest))
+		})
+
+		it("should leave credential values out of the identity", func() {
+			digest := config("//registry.npmjs.org/:_authToken=first\n")
+
+			Expect(config("//registry.npmjs.org/:_authToken=second\n")).To(Equal(digest))
+		})
+
+		it("should ignore settings managed by the buildpack", func() {
+			digest := config("legacy-peer-deps=true\n")
+
+			Expect(config("legacy-peer-deps=true\ncache=/tmp/cache\n")).To(Equal(digest))
+		})
+
+		it("should include the registry override", func() {
+			digest := config("legacy-peer-deps=true\n")
+			Expect(os.Setenv(npm.RegistryEnv, "http://127.0.0.1:8080")).To(Succeed())
+
+			Expect(config("legacy-peer-deps=true\n")).NotTo(Equal(digest))
+		})
+
+		it("should reject settings that move node_modules", func() {
+			test.WriteFile(t, filepath.Join(location, npm.NPMRC), "prefix=/usr/local\n")
+
+			_, err := pkgManager.Config(location)
+			Expect(err).To(MatchError(`.npmrc sets "prefix", which would install packages outside the app's node_modules; remove it`))
+		})
+
+		it("should find the variables it refers to", func() {
+			test.WriteFile(t, filepath.Join(location, npm.NPMRC),
+				"//${REGISTRY_HOST}/:_authToken=${NPM_TOKEN}\n@scope:registry=https://${REGISTRY_HOST}/\nproxy=${PROXY?}\n")
+
+			names, err := npm.NPMRCVariables(location)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(Equal([]string{"NPM_TOKEN", "PROXY", "REGISTRY_HOST"}))
+		})
+	})
+
+	when("parsing .npmrc", func() {
+		it("should parse ini settings", func() {
+			settings, err := npm.ParseNPMRC([]byte(`# comment
+; comment
+registry = "https://registry.example.com/"
+@scope:registry=https://scope.example.com/
+omit[]=dev
+omit[]=optional
+engine-strict
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(settings).To(Equal(map[string]string{
+				"registry":        "https://registry.example.com/",
+				"@scope:registry": "https://scope.example.com/",
+				"omit":            "dev,optional",
+				"engine-strict":   "true",
+			}))
+		})
+	})
+
 	when("rebuilding", func() {
 		it("should run npm rebuild", func() {
 			location := filepath.Join("some", "fake", "dir")
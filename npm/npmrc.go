@@ -0,0 +1,161 @@
+package npm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// NPMRC is the project level npm config file, which npm reads from the app directory it runs in
+const NPMRC = ".npmrc"
+
+// rejectedSettings would make npm install packages somewhere other than the app's node_modules, which the buildpack
+// moves into a layer
+var rejectedSettings = []string{"prefix", "global", "location"}
+
+// managedSettings are overridden by the buildpack on the command line or in the environment, so setting them in
+// .npmrc has no effect
+var managedSettings = []string{"cache", "devdir"}
+
+// secretSettings hold credentials, which are left out of the logs and the layer identity
+var secretSettings = []string{"_auth", "_password", "username", "email", "certfile", "keyfile"}
+
+// ParseNPMRC parses npm's ini config format. Values are returned as written, without expanding ${VAR} references, and
+// "key[]" entries are joined with commas.
+func ParseNPMRC(buf []byte) (map[string]string, error) {
+	settings := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		key, value := line, "true"
+		if i := strings.Index(line, "="); i >= 0 {
+			key, value = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		if strings.HasSuffix(key, "[]") {
+			key = strings.TrimSuffix(key, "[]")
+			if existing, ok := settings[key]; ok {
+				value = existing + "," + value
+			}
+		}
+
+		settings[key] = value
+	}
+
+	return settings, scanner.Err()
+}
+
+// Config validates the app's .npmrc and returns a digest of the settings that affect what npm installs, so that
+// changing them reinstalls node_modules. Settings that conflict with the buildpack's layers are rejected, and
+// settings the buildpack overrides are reported and ignored.
+func (n NPM) Config(location string) (string, error) {
+	settings := map[string]string{}
+
+	buf, err := ioutil.ReadFile(filepath.Join(location, NPMRC))
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("unable to read %s: %s", NPMRC, err.Error())
+	} else if err == nil {
+		if settings, err = ParseNPMRC(buf); err != nil {
+			return "", fmt.Errorf("unable to parse %s: %s", NPMRC, err.Error())
+		}
+	}
+
+	for _, key := range rejectedSettings {
+		if _, ok := settings[key]; ok {
+			return "", fmt.Errorf(`%s sets "%s", which would install packages outside the app's node_modules; remove it`, NPMRC, key)
+		}
+	}
+
+	for _, key := range managedSettings {
+		if _, ok := settings[key]; ok {
+			n.Logger.Info(`Ignoring "%s" from %s, it is managed by the buildpack`, key, NPMRC)
+			delete(settings, key)
+		}
+	}
+
+	if registry := os.Getenv(RegistryEnv); registry != "" {
+		settings["registry"] = registry
+	}
+
+	if len(settings) == 0 {
+		return "", nil
+	}
+
+	var keys []string
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	n.Logger.Info("Using npm config: %s", strings.Join(keys, ", "))
+
+	hash := sha256.New()
+	for _, key := range keys {
+		// A credential changing does not change what is installed, but adding or removing one can
+		if secret(key) {
+			_, _ = fmt.Fprintf(hash, "%s\n", key)
+		} else {
+			_, _ = fmt.Fprintf(hash, "%s=%s\n", key, settings[key])
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+var variableReference = regexp.MustCompile(`\$\{([^}?]+)\??\}`)
+
+// NPMRCVariables returns the environment variables the app's .npmrc refers to as ${VAR}, such as a registry token,
+// which npm needs in its environment
+func NPMRCVariables(location string) ([]string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(location, NPMRC))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %s", NPMRC, err.Error())
+	}
+
+	names := map[string]bool{}
+	for _, match := range variableReference.FindAllSubmatch(buf, -1) {
+		names[string(match[1])] = true
+	}
+
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	return sorted, nil
+}
+
+func secret(key string) bool {
+	name := key
+	if i := strings.LastIndex(key, ":"); i >= 0 {
+		name = key[i+1:]
+	}
+
+	for _, s := range secretSettings {
+		if strings.HasPrefix(name, s) {
+			return true
+		}
+	}
+
+	return false
+}
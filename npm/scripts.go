@@ -0,0 +1,296 @@
+package npm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/libcfbuildpack/helper"
+	"github.com/cloudfoundry/npm-cnb/modules"
+)
+
+// ScriptsAllowlistEnv lists the packages whose install scripts may run, separated by commas. Every other dependency
+// is installed with --ignore-scripts; "*" allows all of them.
+const ScriptsAllowlistEnv = "BP_NPM_SCRIPTS_ALLOWLIST"
+
+// dependencyScripts are the lifecycle scripts npm runs for a dependency when it is installed
+var dependencyScripts = []string{"preinstall", "install", "postinstall"}
+
+// appLifecycle are the lifecycle scripts npm runs for the app itself after installing its dependencies, in order
+var appLifecycle = []string{"preinstall", "install", "postinstall", "prepare"}
+
+// allowlist is the parsed ScriptsAllowlistEnv
+type allowlist struct {
+	all      bool
+	packages []string
+}
+
+func scriptsAllowlist() allowlist {
+	var a allowlist
+
+	for _, name := range strings.Split(os.Getenv(ScriptsAllowlistEnv), ",") {
+		name = strings.TrimSpace(name)
+
+		switch name {
+		case "":
+		case "*":
+			a.all = true
+		default:
+			a.packages = append(a.packages, name)
+		}
+	}
+
+	return a
+}
+
+func (a allowlist) allows(name string) bool {
+	if a.all {
+		return true
+	}
+
+	for _, p := range a.packages {
+		if p == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+type manifest struct {
+	Name    string            `json:"name"`
+	Scripts map[string]string `json:"scripts"`
+}
+
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return m, err
+	}
+
+	err = json.Unmarshal(buf, &m)
+	return m, err
+}
+
+// appScripts returns the install scripts the app itself defines
+func appScripts(location string) ([]string, error) {
+	m, err := readManifest(location)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var scripts []string
+	for _, s := range appLifecycle {
+		if _, ok := m.Scripts[s]; ok {
+			scripts = append(scripts, s)
+		}
+	}
+
+	return scripts, nil
+}
+
+// ScriptedPackages returns the names of the packages under nodeModules that have install scripts, including the
+// implicit node-gyp build of packages that ship a binding.gyp
+func ScriptedPackages(nodeModules string) ([]string, error) {
+	names := map[string]bool{}
+
+	if exists, err := helper.FileExists(nodeModules); err != nil || !exists {
+		return nil, err
+	}
+
+	err := filepath.Walk(nodeModules, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || info.Name() != "package.json" {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		m, err := readManifest(dir)
+		if err != nil || m.Name == "" {
+			// Test fixtures and templates inside packages are not packages
+			return nil
+		}
+
+		for _, s := range dependencyScripts {
+			if _, ok := m.Scripts[s]; ok {
+				names[m.Name] = true
+			}
+		}
+
+		if exists, err := helper.FileExists(filepath.Join(dir, "binding.gyp")); err != nil {
+			return err
+		} else if exists {
+			names[m.Name] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	return sorted, nil
+}
+
+// runScripts runs the install scripts that --ignore-scripts skipped for the allowlisted packages and reports the
+// packages whose scripts did not run. With reuse, the scripts of native addons restored compiled from the native cache
+// in this build are not run again.
+func (n NPM) runScripts(location string, reuse bool) error {
+	allowed := scriptsAllowlist()
+	if allowed.all {
+		return nil
+	}
+
+	nodeModules := filepath.Join(location, modules.ModulesDir)
+
+	scripted, err := ScriptedPackages(nodeModules)
+	if err != nil {
+		return err
+	}
+
+	restored := map[string]bool{}
+	if reuse {
+		if restored, err = restoredAddons(nodeModules); err != nil {
+			return err
+		}
+	}
+
+	var run, skipped, reused []string
+	for _, name := range scripted {
+		if restored[name] {
+			reused = append(reused, name)
+		} else if allowed.allows(name) {
+			run = append(run, name)
+		} else {
+			skipped = append(skipped, name)
+		}
+	}
+
+	if len(reused) > 0 {
+		n.Logger.Info("Not running install scripts of %s, which were restored compiled", strings.Join(reused, ", "))
+	}
+
+	if len(skipped) > 0 {
+		n.Logger.Info("Not running install scripts of %s; add packages to %s to run their scripts", strings.Join(skipped, ", "), ScriptsAllowlistEnv)
+	}
+
+	if len(run) > 0 {
+		n.Logger.Info("Running install scripts of %s", strings.Join(run, ", "))
+		if err := n.Metrics.Time("npm install scripts", func() error {
+			return n.scriptRunner().Run("npm", location, append([]string{"rebuild"}, run...)...)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoredAddons returns the native addons under nodeModules that were restored compiled from the native cache, which
+// only holds addons built for the current Node.js ABI and architecture, and removes the marker restoring left. An addon
+// counts as restored only if every copy of it was.
+func restoredAddons(nodeModules string) (map[string]bool, error) {
+	addons, err := modules.FindNativeAddons(nodeModules)
+	if err != nil {
+		return nil, err
+	}
+
+	restored := map[string]bool{}
+	for _, addon := range addons {
+		marker := filepath.Join(addon.Path, modules.PrebuildMarker)
+
+		exists, err := helper.FileExists(marker)
+		if err != nil {
+			return nil, err
+		}
+
+		if previous, ok := restored[addon.Name]; !ok || previous {
+			restored[addon.Name] = exists
+		}
+
+		if err := os.RemoveAll(marker); err != nil {
+			return nil, err
+		}
+	}
+
+	return restored, nil
+}
+
+func (n NPM) scriptRunner() Runner {
+	if n.ScriptRunner != nil {
+		return n.ScriptRunner
+	}
+	return n.Runner
+}
+
+// InstalledHeaders returns the directory of the node on the PATH when it was installed with its headers, so that
+// node-gyp, pointed at it with npm_config_nodedir, compiles addons without downloading them, which a sandboxed script
+// may not be able to do. It returns "" when npm_config_nodedir is already set or there are no headers.
+func InstalledHeaders() (string, error) {
+	if os.Getenv("npm_config_nodedir") != "" {
+		return "", nil
+	}
+
+	node, err := exec.LookPath("node")
+	if err != nil {
+		return "", nil
+	}
+
+	if node, err = filepath.EvalSymlinks(node); err != nil {
+		return "", err
+	}
+
+	nodeDir := filepath.Dir(filepath.Dir(node))
+	if exists, err := helper.FileExists(filepath.Join(nodeDir, "include", "node", "common.gypi")); err != nil || !exists {
+		return "", err
+	}
+
+	return nodeDir, nil
+}
+
+// runAppScripts runs the app's own install scripts, which npm skips along with its dependencies' when installing with
+// --ignore-scripts
+func (n NPM) runAppScripts(location string) error {
+	if scriptsAllowlist().all {
+		return nil
+	}
+
+	scripts, err := appScripts(location)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range scripts {
+		if err := n.Runner.Run("npm", location, "run-script", s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ignoreScripts returns the flag that stops npm running dependency scripts unless every package is allowed to
+func ignoreScripts() []string {
+	if scriptsAllowlist().all {
+		return nil
+	}
+
+	return []string{"--ignore-scripts"}
+}
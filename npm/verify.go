@@ -0,0 +1,125 @@
+package npm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// CacheVerifyEnv chooses when to run `npm cache verify`: "always", "never", "changed" (the default) or a number N
+	// to verify every Nth build
+	CacheVerifyEnv = "BP_NPM_CACHE_VERIFY"
+
+	verifyStateFile = "_cnb-verify.json"
+)
+
+type verifyState struct {
+	Digest string `json:"digest"`
+	Builds int    `json:"builds"`
+}
+
+// shouldVerify decides whether the cache needs verifying and returns the state to record if it is skipped
+func shouldVerify(npmCache string) (bool, verifyState, error) {
+	mode := os.Getenv(CacheVerifyEnv)
+
+	digest, err := cacheDigest(npmCache)
+	if err != nil {
+		return false, verifyState{}, err
+	}
+
+	previous, err := readVerifyState(npmCache)
+	if err != nil {
+		return false, verifyState{}, err
+	}
+
+	skipped := verifyState{Digest: previous.Digest, Builds: previous.Builds + 1}
+
+	switch mode {
+	case "always":
+		return true, skipped, nil
+	case "never":
+		return false, skipped, nil
+	case "", "changed":
+		return previous.Digest == "" || previous.Digest != digest, skipped, nil
+	}
+
+	every, err := strconv.Atoi(mode)
+	if err != nil || every < 1 {
+		return false, verifyState{}, fmt.Errorf(`invalid %s %q, expected "always", "never", "changed" or a positive number`, CacheVerifyEnv, mode)
+	}
+
+	return previous.Digest == "" || skipped.Builds >= every, skipped, nil
+}
+
+// recordVerify stores the state of the cache after a verify, or after a skipped verify, for the next build
+func recordVerify(npmCache string, state verifyState) error {
+	if _, err := os.Stat(npmCache); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(npmCache, verifyStateFile), buf, 0644)
+}
+
+func readVerifyState(npmCache string) (verifyState, error) {
+	var state verifyState
+
+	buf, err := ioutil.ReadFile(filepath.Join(npmCache, verifyStateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return verifyState{}, nil
+	}
+
+	return state, nil
+}
+
+// cacheDigest hashes the cacache index, which records the integrity of every entry in the cache
+func cacheDigest(npmCache string) (string, error) {
+	index := filepath.Join(npmCache, "_cacache", "index-v5")
+	hash := sha256.New()
+
+	if _, err := os.Stat(index); os.IsNotExist(err) {
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	err := filepath.Walk(index, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(index, path)
+		if err != nil {
+			return err
+		}
+		_, _ = io.WriteString(hash, rel+"\x00")
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(hash, f)
+		return err
+	})
+
+	return hex.EncodeToString(hash.Sum(nil)), err
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// EnvAllowlistEnv lists further variables passed to npm and install scripts, separated by commas. A trailing "*"
+// matches every variable with that prefix.
+const EnvAllowlistEnv = "BP_NPM_ENV_ALLOWLIST"
+
+// allowedEnv are the variables commands need from the build environment. A trailing "*" matches a prefix, other than
+// of variables holding credentials.
+var allowedEnv = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "TZ", "TMPDIR", "LANG", "LANGUAGE", "LC_*", "CI",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+	"NODE_ENV", "NODE_OPTIONS", "NODE_EXTRA_CA_CERTS", "NODE_HOME", "NODE_PATH", "NODE_VERBOSE", "NODE_ICU_DATA",
+	"NODE_NO_WARNINGS", "NODE_PENDING_DEPRECATION", "NODE_PRESERVE_SYMLINKS", "NODE_TLS_REJECT_UNAUTHORIZED",
+	"NPM_CONFIG_*", "npm_config_*", "GIT_*", "SSH_AUTH_SOCK",
+	"CC", "CXX", "CFLAGS", "CXXFLAGS", "CPPFLAGS", "LDFLAGS", "MAKEFLAGS", "PYTHON",
+	"LD_LIBRARY_PATH", "LIBRARY_PATH", "CPATH", "PKG_CONFIG_PATH",
+}
+
+// envModifiers are the suffixes of buildpack env files, which name the variable they modify
+var envModifiers = []string{".append", ".default", ".delim", ".override", ".prepend"}
+
+var urlCredentials = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s]+@`)
+
+// Environment returns the variables from the build environment that are allowlisted, named in extra or in
+// EnvAllowlistEnv. Variables holding credentials are only passed when named exactly in allowedEnv or extra. Entries of
+// extra in the form NAME=value are set rather than passed through, replacing any variable of that name.
+func Environment(extra []string) []string {
+	named := map[string]bool{}
+	var patterns []string
+	for _, pattern := range allowedEnv {
+		if strings.HasSuffix(pattern, "*") {
+			patterns = append(patterns, pattern)
+		} else {
+			named[pattern] = true
+		}
+	}
+
+	var settings []string
+	set := map[string]bool{}
+	for _, entry := range extra {
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			settings = append(settings, entry)
+			set[parts[0]] = true
+		} else if strings.HasSuffix(entry, "*") {
+			patterns = append(patterns, entry)
+		} else {
+			named[entry] = true
+		}
+	}
+
+	for _, name := range strings.Split(os.Getenv(EnvAllowlistEnv), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			patterns = append(patterns, name)
+		}
+	}
+
+	// An empty, rather than nil, environment stops exec inheriting the build's
+	env := []string{}
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if set[name] {
+			continue
+		}
+
+		if named[name] {
+			env = append(env, variable)
+			continue
+		}
+
+		if Credential(name) {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if pattern == name || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))) {
+				env = append(env, variable)
+				break
+			}
+		}
+	}
+
+	return append(env, settings...)
+}
+
+// BuildpackEnv returns the names of the variables set by the env files of the layers under layersRoot, which holds a
+// directory for each buildpack
+func BuildpackEnv(layersRoot string) ([]string, error) {
+	names := map[string]bool{}
+
+	for _, dir := range []string{"env", "env.build"} {
+		files, err := filepath.Glob(filepath.Join(layersRoot, "*", "*", dir, "*"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			name := filepath.Base(file)
+			for _, modifier := range envModifiers {
+				name = strings.TrimSuffix(name, modifier)
+			}
+			names[name] = true
+		}
+	}
+
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	return sorted, nil
+}
+
+// RedactEnv replaces the values of credentials, and credentials embedded in URLs, so that an environment can be logged
+func RedactEnv(env []string) []string {
+	var redacted []string
+
+	for _, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 {
+			redacted = append(redacted, variable)
+		} else if Credential(parts[0]) {
+			redacted = append(redacted, parts[0]+"=[REDACTED]")
+		} else {
+			redacted = append(redacted, parts[0]+"="+urlCredentials.ReplaceAllString(parts[1], "${1}[REDACTED]@"))
+		}
+	}
+
+	return redacted
+}
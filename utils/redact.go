@@ -0,0 +1,292 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redacted = "[REDACTED]"
+
+	// minSecretLength keeps short values, such as "true" in a variable that happens to be named like a credential, from
+	// being redacted wherever they appear
+	minSecretLength = 6
+
+	// maxLineLength is the longest incomplete line RedactingWriter holds back waiting for its end
+	maxLineLength = 64 * 1024
+
+	// flushTimeout bounds how long restoring the output waits for processes that still hold it, such as a daemon
+	// started by an install script
+	flushTimeout = 5 * time.Second
+)
+
+// bindingRootEnv are the variables that point at service bindings directories
+var bindingRootEnv = []string{"CNB_BINDINGS", "SERVICE_BINDING_ROOT"}
+
+// bindingMetadata are the files of a service binding that describe it rather than hold credentials
+var bindingMetadata = []string{"type", "provider", "kind", "tags"}
+
+var credentialSettings = regexp.MustCompile(`(_authToken|_auth|_password)(\s*[=:]\s*"?)[^\s"]+`)
+
+// Redactor replaces secrets, and text shaped like npm credentials or URLs with embedded credentials, with
+// [REDACTED]. Secrets may be added while it is in use.
+type Redactor struct {
+	mutex   sync.RWMutex
+	secrets []string
+}
+
+func NewRedactor() *Redactor {
+	return &Redactor{}
+}
+
+// Add adds secret values to redact
+func (r *Redactor) Add(secrets ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, secret := range secrets {
+		secret = strings.TrimSpace(secret)
+		if len(secret) < minSecretLength || r.contains(secret) {
+			continue
+		}
+		r.secrets = append(r.secrets, secret)
+	}
+
+	// Longer secrets first, so that one containing another is redacted whole
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+}
+
+func (r *Redactor) contains(secret string) bool {
+	for _, s := range r.secrets {
+		if s == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// AddEnvironment adds the values of credential variables, the credentials in VCAP_SERVICES and the contents of the
+// service bindings the environment points at
+func (r *Redactor) AddEnvironment(env []string) error {
+	for _, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || !Credential(parts[0]) {
+			continue
+		}
+
+		if parts[0] == "VCAP_SERVICES" {
+			var services interface{}
+			if err := json.Unmarshal([]byte(parts[1]), &services); err == nil {
+				r.Add(credentialValues(services, false)...)
+			}
+		}
+
+		if bindingRoot(parts[0]) {
+			if filepath.IsAbs(parts[1]) {
+				if err := r.AddBindings(parts[1]); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		r.Add(parts[1])
+	}
+
+	return nil
+}
+
+// AddBindings adds the contents of the regular files under path, a service bindings directory or a single credential
+// file, other than those describing a binding
+func (r *Redactor) AddBindings(path string) error {
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Kubernetes projects bindings through symlinks, which Walk does not follow
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(file); err != nil {
+				return nil
+			}
+		}
+
+		// Sockets, pipes and devices cannot be read like files, and hold no credentials to redact
+		if !info.Mode().IsRegular() || metadataFile(info.Name()) || info.Size() > maxLineLength {
+			return nil
+		}
+
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		// Output is redacted a line at a time, so multi-line secrets such as keys are redacted line by line
+		r.Add(string(buf))
+		r.Add(strings.Split(string(buf), "\n")...)
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func bindingRoot(name string) bool {
+	for _, b := range bindingRootEnv {
+		if name == b {
+			return true
+		}
+	}
+	return false
+}
+
+func metadataFile(name string) bool {
+	for _, m := range bindingMetadata {
+		if name == m {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialValues returns the strings within the "credentials" of the services in a VCAP_SERVICES document
+func credentialValues(value interface{}, inCredentials bool) []string {
+	var values []string
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			values = append(values, credentialValues(child, inCredentials || key == "credentials")...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			values = append(values, credentialValues(child, inCredentials)...)
+		}
+	case string:
+		if inCredentials {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// Redact returns s with secrets replaced
+func (r *Redactor) Redact(s string) string {
+	r.mutex.RLock()
+	for _, secret := range r.secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	r.mutex.RUnlock()
+
+	s = credentialSettings.ReplaceAllString(s, "${1}${2}"+redacted)
+	return urlCredentials.ReplaceAllString(s, "${1}"+redacted+"@")
+}
+
+// RedactingWriter redacts what is written to it a line at a time, so that a secret split across writes is still
+// redacted. Flush writes an incomplete last line.
+type RedactingWriter struct {
+	writer   io.Writer
+	redactor *Redactor
+	mutex    sync.Mutex
+	buf      []byte
+}
+
+func NewRedactingWriter(writer io.Writer, redactor *Redactor) *RedactingWriter {
+	return &RedactingWriter{writer: writer, redactor: redactor}
+}
+
+func (w *RedactingWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	// Progress output ends lines with carriage returns
+	end := bytes.LastIndexAny(w.buf, "\r\n") + 1
+	if end == 0 && len(w.buf) < maxLineLength {
+		return len(p), nil
+	} else if end == 0 {
+		end = len(w.buf)
+	}
+
+	if err := w.write(end); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *RedactingWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.write(len(w.buf))
+}
+
+func (w *RedactingWriter) write(end int) error {
+	if end == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(w.writer, w.redactor.Redact(string(w.buf[:end])))
+	w.buf = append(w.buf[:0], w.buf[end:]...)
+	return err
+}
+
+// RedactOutput redirects the process's stdout and stderr through redactor, which also covers the output of the
+// commands it runs and of loggers created afterwards. The returned function restores them once their output has been
+// written.
+func RedactOutput(redactor *Redactor) (func(), error) {
+	var restores []func()
+
+	for _, stream := range []**os.File{&os.Stdout, &os.Stderr} {
+		original := *stream
+
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+
+		done := make(chan struct{})
+		go func() {
+			w := NewRedactingWriter(original, redactor)
+			_, _ = io.Copy(w, reader)
+			_ = w.Flush()
+			close(done)
+		}()
+
+		*stream = writer
+		stream := stream
+
+		restores = append(restores, func() {
+			*stream = original
+			_ = writer.Close()
+
+			select {
+			case <-done:
+			case <-time.After(flushTimeout):
+			}
+		})
+	}
+
+	return func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}, nil
+}
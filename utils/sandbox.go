@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SandboxEnv runs dependency install scripts without the sandbox when "false"
+	SandboxEnv = "BP_NPM_SCRIPTS_SANDBOX"
+
+	// SandboxNetworkEnv lets sandboxed install scripts reach the network when "true", e.g. to download prebuilt binaries
+	SandboxNetworkEnv = "BP_NPM_SCRIPTS_NETWORK"
+
+	// sandboxArg is the first argument of a buildpack binary re-executed to isolate itself before running a command
+	sandboxArg = "sandbox-exec"
+
+	// sandboxUnavailable is the exit code of a re-executed binary that was unable to isolate itself, in which case the
+	// command has not run
+	sandboxUnavailable = 125
+)
+
+// credentialEnv are removed from the environment of sandboxed commands, along with variables whose name contains one
+// of credentialMarkers, even when allowlisted
+var credentialEnv = []string{"VCAP_SERVICES", "CNB_BINDINGS", "SERVICE_BINDING_ROOT", "CF_INSTANCE_CERT", "CF_INSTANCE_KEY"}
+
+var credentialMarkers = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL", "AUTH", "PRIVATE_KEY", "API_KEY", "APIKEY", "ACCESS_KEY"}
+
+// credentialPaths are the variables that point at service binding credentials on the filesystem
+var credentialPaths = []string{"CNB_BINDINGS", "SERVICE_BINDING_ROOT", "CF_INSTANCE_CERT", "CF_INSTANCE_KEY"}
+
+type Logger interface {
+	Info(format string, args ...interface{})
+}
+
+// Sandbox runs commands that execute dependency install scripts in Linux user namespaces, with credentials removed
+// from their environment, a read-only filesystem except for Writable and a private temporary directory and home, Hidden
+// paths and service bindings replaced by empty ones and, unless Network is set, no network. Commands that cannot be
+// isolated fail without running.
+type Sandbox struct {
+	// Writable are the directories commands may write to. Relative paths are resolved against the command's directory.
+	Writable []string
+
+	// Hidden are the files and directories commands may not read
+	Hidden []string
+
+	// Env names variables passed to commands in addition to the allowlisted ones, or sets them as NAME=value, unless they
+	// hold credentials
+	Env []string
+
+	Network bool
+	Logger  Logger
+}
+
+// sandboxConfig is passed to the re-executed buildpack binary
+type sandboxConfig struct {
+	Writable []string `json:"writable"`
+	Scratch  []string `json:"scratch"`
+	Hidden   []string `json:"hidden"`
+	Network  bool     `json:"network"`
+}
+
+// ParseSandboxEnv returns whether install scripts run in a sandbox, and whether that sandbox has network access
+func ParseSandboxEnv() (enabled bool, network bool, err error) {
+	enabled, network = true, false
+
+	if value := os.Getenv(SandboxEnv); value != "" {
+		if enabled, err = strconv.ParseBool(value); err != nil {
+			return false, false, fmt.Errorf("unable to parse %s: %s", SandboxEnv, err.Error())
+		}
+	}
+
+	if value := os.Getenv(SandboxNetworkEnv); value != "" {
+		if network, err = strconv.ParseBool(value); err != nil {
+			return false, false, fmt.Errorf("unable to parse %s: %s", SandboxNetworkEnv, err.Error())
+		}
+	}
+
+	return enabled, network, nil
+}
+
+func (s Sandbox) Run(bin, dir string, args ...string) error {
+	return s.run(bin, dir, args, func(cmd *exec.Cmd) error {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	})
+}
+
+func (s Sandbox) RunWithOutput(bin, dir string, args ...string) (string, error) {
+	var output []byte
+
+	err := s.run(bin, dir, args, func(cmd *exec.Cmd) error {
+		var err error
+		cmd.Stderr = os.Stderr
+		output, err = cmd.Output()
+		return err
+	})
+
+	return string(output), err
+}
+
+func (s Sandbox) run(bin, dir string, args []string, run func(cmd *exec.Cmd) error) error {
+	config := s.config(dir)
+	env := scrubEnv(Environment(s.Env))
+
+	if logger, ok := s.Logger.(DebugLogger); ok {
+		logger.Debug("Environment of sandboxed %s:\n  %s", strings.Join(append([]string{bin}, args...), " "), strings.Join(RedactEnv(env), "\n  "))
+	}
+
+	cmd, err := isolatedCommand(config, bin, args...)
+	if err == nil {
+		cmd.Dir = dir
+		// Commands run as root in the user namespace, where npm 6 would drop to the unmapped user nobody to run scripts
+		cmd.Env = append(env, "npm_config_unsafe_perm=true")
+
+		err = run(cmd)
+		if !isolationFailed(err) {
+			if err != nil {
+				s.Logger.Info("Install scripts failed in the sandbox, which only lets them write to %s and hides credentials%s. Set %s=false to run them without it.",
+					strings.Join(config.Writable, ", "), s.networkNote(), SandboxEnv)
+			}
+			return err
+		}
+	}
+
+	return fmt.Errorf("unable to isolate install scripts, set %s=false to run them without a sandbox: %s", SandboxEnv, err.Error())
+}
+
+func (s Sandbox) networkNote() string {
+	if s.Network {
+		return ""
+	}
+	return fmt.Sprintf(" and the network (set %s=true to allow it)", SandboxNetworkEnv)
+}
+
+func (s Sandbox) config(dir string) sandboxConfig {
+	config := sandboxConfig{Network: s.Network}
+
+	for _, path := range s.Writable {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		config.Writable = append(config.Writable, filepath.Clean(path))
+	}
+
+	// Scripts get an empty temporary directory and home, unless that would hide the directory they run in
+	for _, path := range []string{os.TempDir(), os.Getenv("HOME")} {
+		if path != "" && filepath.IsAbs(path) && !within(dir, filepath.Clean(path)) {
+			config.Scratch = append(config.Scratch, filepath.Clean(path))
+		}
+	}
+
+	config.Hidden = append(config.Hidden, s.Hidden...)
+	for _, name := range credentialPaths {
+		if path := os.Getenv(name); filepath.IsAbs(path) {
+			config.Hidden = append(config.Hidden, filepath.Clean(path))
+		}
+	}
+
+	return config
+}
+
+func (c sandboxConfig) encode() (string, error) {
+	buf, err := json.Marshal(c)
+	return string(buf), err
+}
+
+// SandboxMain runs a command in the sandbox when the buildpack binary was re-executed by Sandbox, and returns
+// otherwise. It must be the first thing main does.
+func SandboxMain() {
+	if len(os.Args) < 4 || os.Args[1] != sandboxArg {
+		return
+	}
+
+	var config sandboxConfig
+	if err := json.Unmarshal([]byte(os.Args[2]), &config); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "unable to read sandbox config: %s\n", err.Error())
+		os.Exit(sandboxUnavailable)
+	}
+
+	// enterSandbox only returns if it is unable to run the command
+	err := enterSandbox(config, os.Args[3], os.Args[4:])
+	_, _ = fmt.Fprintf(os.Stderr, "unable to enter sandbox: %s\n", err.Error())
+	os.Exit(sandboxUnavailable)
+}
+
+// isolationFailed reports whether err means the command could not be isolated and has not run
+func isolationFailed(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Op == "fork/exec" {
+		return true
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == sandboxUnavailable {
+		return true
+	}
+
+	return false
+}
+
+func scrubEnv(env []string) []string {
+	scrubbed := []string{}
+
+	for _, variable := range env {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if !Credential(name) {
+			scrubbed = append(scrubbed, variable)
+		}
+	}
+
+	return scrubbed
+}
+
+// Credential reports whether the variable name is one that holds credentials
+func Credential(name string) bool {
+	for _, c := range credentialEnv {
+		if name == c {
+			return true
+		}
+	}
+
+	upper := strings.ToUpper(name)
+	for _, marker := range credentialMarkers {
+		if strings.Contains(upper, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// within reports whether path is parent or one of its descendants
+func within(path, parent string) bool {
+	rel, err := filepath.Rel(parent, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
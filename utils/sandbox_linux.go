@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	prSetNoNewPrivs = 38
+
+	// lockedFlags are the mount flags a user namespace may not clear, which a remount has to repeat
+	lockedFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME
+)
+
+// isolatedCommand re-executes the buildpack binary in new user, mount, PID and, unless the network is allowed,
+// network namespaces, where SandboxMain restricts the filesystem before running the command
+func isolatedCommand(config sandboxConfig, bin string, args ...string) (*exec.Cmd, error) {
+	// Sandboxed commands run as the same user as the buildpack, with or without namespaces, and may not read its
+	// environment
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0); errno != 0 {
+		return nil, fmt.Errorf("unable to protect the buildpack's environment: %s", errno.Error())
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := config.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(self, append([]string{sandboxArg, encoded, bin}, args...)...)
+
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if !config.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	// The command runs as root in its namespace so that it can set up its mounts, and as the build user outside it
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 uintptr(flags),
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+	}
+
+	return cmd, nil
+}
+
+func enterSandbox(config sandboxConfig, bin string, args []string) error {
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return err
+	}
+
+	runtime.LockOSThread()
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("unable to make mounts private: %s", err.Error())
+	}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mounts {
+		if err := remount(m, syscall.MS_RDONLY); err != nil {
+			return fmt.Errorf("unable to make %s read-only: %s", m, err.Error())
+		}
+	}
+
+	// A /proc for the new PID namespace hides other processes. Container runtimes that mask parts of /proc prevent
+	// it, leaving the buildpack's own environment protected by it not being dumpable.
+	_ = syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	for _, dir := range config.Scratch {
+		if !isDir(dir) {
+			continue
+		}
+
+		if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("unable to mount %s: %s", dir, err.Error())
+		}
+	}
+
+	for _, dir := range config.Writable {
+		if !isDir(dir) {
+			continue
+		}
+
+		if err := syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("unable to mount %s: %s", dir, err.Error())
+		}
+
+		if err := remount(dir, 0); err != nil {
+			return fmt.Errorf("unable to make %s writable: %s", dir, err.Error())
+		}
+	}
+
+	for _, hidden := range config.Hidden {
+		info, err := os.Stat(hidden)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			err = syscall.Mount("tmpfs", hidden, "tmpfs", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "size=0")
+		} else {
+			err = syscall.Mount(os.DevNull, hidden, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("unable to hide %s: %s", hidden, err.Error())
+		}
+	}
+
+	// Without capabilities the command is unable to undo the mounts above
+	if err := dropCapabilities(); err != nil {
+		return err
+	}
+
+	return syscall.Exec(path, append([]string{bin}, args...), os.Environ())
+}
+
+// remount changes the flags of a mount, keeping those that cannot be changed. Mounts that are already read-only, such
+// as the kernel filesystems container runtimes mask parts of /proc and /sys with, are left as they are.
+func remount(target string, flags uintptr) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(target, &stat); err != nil {
+		return err
+	}
+
+	if flags&syscall.MS_RDONLY != 0 && uintptr(stat.Flags)&syscall.MS_RDONLY != 0 {
+		return nil
+	}
+
+	return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags|(uintptr(stat.Flags)&lockedFlags), "")
+}
+
+func dropCapabilities() error {
+	for c := 0; ; c++ {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(c), 0); errno == syscall.EINVAL {
+			break
+		} else if errno != 0 {
+			return fmt.Errorf("unable to drop capabilities: %s", errno.Error())
+		}
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("unable to drop privileges: %s", errno.Error())
+	}
+
+	return nil
+}
+
+func mountPoints() ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 4 {
+			mounts = append(mounts, unescapeMountPoint(fields[4]))
+		}
+	}
+
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPoint decodes the octal escapes mountinfo uses for spaces and other special characters
+func unescapeMountPoint(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+func isolatedCommand(config sandboxConfig, bin string, args ...string) (*exec.Cmd, error) {
+	return nil, fmt.Errorf("namespaces are not available on %s", runtime.GOOS)
+}
+
+func enterSandbox(config sandboxConfig, bin string, args []string) error {
+	return fmt.Errorf("namespaces are not available on %s", runtime.GOOS)
+}
@@ -0,0 +1,119 @@
+package utils_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/libcfbuildpack/test"
+	"github.com/cloudfoundry/npm-cnb/utils"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/gomega"
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+)
+
+//go:generate mockgen -source=sandbox.go -destination=mocks_test.go -package=utils_test
+
+func TestMain(m *testing.M) {
+	// Sandboxed commands re-execute the test binary
+	utils.SandboxMain()
+	os.Exit(m.Run())
+}
+
+func TestUnitSandbox(t *testing.T) {
+	spec.Run(t, "Sandbox", testSandbox, spec.Report(report.Terminal{}))
+}
+
+func testSandbox(t *testing.T, when spec.G, it spec.S) {
+	var (
+		mockCtrl   *gomock.Controller
+		mockLogger *MockLogger
+		appRoot    string
+		sandbox    utils.Sandbox
+	)
+
+	it.Before(func() {
+		RegisterTestingT(t)
+		mockCtrl = gomock.NewController(t)
+		mockLogger = NewMockLogger(mockCtrl)
+		mockLogger.EXPECT().Info(gomock.Any(), gomock.Any()).AnyTimes()
+
+		var err error
+		appRoot, err = ioutil.TempDir("", "app")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(appRoot, "node_modules"), 0755)).To(Succeed())
+
+		sandbox = utils.Sandbox{Writable: []string{"node_modules"}, Logger: mockLogger}
+	})
+
+	it.After(func() {
+		mockCtrl.Finish()
+		Expect(os.Unsetenv("NPM_TOKEN")).To(Succeed())
+		Expect(os.Unsetenv("VCAP_SERVICES")).To(Succeed())
+		Expect(os.Unsetenv(utils.SandboxEnv)).To(Succeed())
+		Expect(os.Unsetenv(utils.SandboxNetworkEnv)).To(Succeed())
+		Expect(os.RemoveAll(appRoot)).To(Succeed())
+	})
+
+	it("removes credentials from the environment", func() {
+		Expect(os.Setenv("NPM_TOKEN", "some-token")).To(Succeed())
+		Expect(os.Setenv("VCAP_SERVICES", "{}")).To(Succeed())
+
+		output, err := sandbox.RunWithOutput("env", appRoot)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(output).To(ContainSubstring("PATH="))
+		Expect(output).NotTo(ContainSubstring("NPM_TOKEN"))
+		Expect(output).NotTo(ContainSubstring("VCAP_SERVICES"))
+	})
+
+	it("lets commands write to the writable directories", func() {
+		Expect(sandbox.Run("touch", appRoot, filepath.Join("node_modules", "built"))).To(Succeed())
+		Expect(filepath.Join(appRoot, "node_modules", "built")).To(BeARegularFile())
+	})
+
+	it("fails when commands write elsewhere in the app", func() {
+		test.WriteFile(t, filepath.Join(appRoot, "index.js"), "")
+
+		Expect(sandbox.Run("sh", appRoot, "-c", "echo changed > index.js")).NotTo(Succeed())
+	})
+
+	it("runs the install scripts of packages", func() {
+		if _, err := exec.LookPath("npm"); err != nil {
+			t.Skip("npm is not available")
+		}
+
+		test.WriteFile(t, filepath.Join(appRoot, "package.json"), `{"name": "app", "version": "1.0.0", "dependencies": {"scripted": "1.0.0"}}`)
+		test.WriteFile(t, filepath.Join(appRoot, "node_modules", "scripted", "package.json"),
+			`{"name": "scripted", "version": "1.0.0", "scripts": {"install": "node -e \"require('fs').writeFileSync('built', '')\""}}`)
+
+		Expect(sandbox.Run("npm", appRoot, "rebuild", "scripted")).To(Succeed())
+		Expect(filepath.Join(appRoot, "node_modules", "scripted", "built")).To(BeARegularFile())
+	})
+
+	when("parsing the sandbox settings", func() {
+		it("sandboxes scripts without network access by default", func() {
+			enabled, network, err := utils.ParseSandboxEnv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(enabled).To(BeTrue())
+			Expect(network).To(BeFalse())
+		})
+
+		it("can allow network access", func() {
+			Expect(os.Setenv(utils.SandboxNetworkEnv, "true")).To(Succeed())
+
+			_, network, err := utils.ParseSandboxEnv()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(network).To(BeTrue())
+		})
+
+		it("rejects an invalid setting", func() {
+			Expect(os.Setenv(utils.SandboxEnv, "maybe")).To(Succeed())
+
+			_, _, err := utils.ParseSandboxEnv()
+			Expect(err).To(MatchError(ContainSubstring("unable to parse BP_NPM_SCRIPTS_SANDBOX")))
+		})
+	})
+}
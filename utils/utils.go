@@ -3,15 +3,43 @@ package utils
 import (
 	"os"
 	"os/exec"
+	"strings"
 )
 
+type DebugLogger interface {
+	Debug(format string, args ...interface{})
+}
+
+// CommandRunner runs commands with only the allowlisted variables from the build environment, and those named or set,
+// as NAME=value, in Env.
+// When Logger is set, the redacted environment of each command is logged at debug level.
 type CommandRunner struct {
+	Env    []string
+	Logger DebugLogger
 }
 
 func (r CommandRunner) Run(bin, dir string, args ...string) error {
-	cmd := exec.Command(bin, args...)
-	cmd.Dir = dir
+	cmd := r.command(bin, dir, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
+
+func (r CommandRunner) RunWithOutput(bin, dir string, args ...string) (string, error) {
+	cmd := r.command(bin, dir, args...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	return string(output), err
+}
+
+func (r CommandRunner) command(bin, dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = dir
+	cmd.Env = Environment(r.Env)
+
+	if r.Logger != nil {
+		r.Logger.Debug("Environment of %s:\n  %s", strings.Join(append([]string{bin}, args...), " "), strings.Join(RedactEnv(cmd.Env), "\n  "))
+	}
+
+	return cmd
+}